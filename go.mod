@@ -0,0 +1,3 @@
+module github.com/gkmzfk6um/JSON_Server
+
+go 1.20
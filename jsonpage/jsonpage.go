@@ -0,0 +1,501 @@
+// Package jsonpage parses JSON Server content files into content items, keeping the
+// key order of the JSON text, which encoding/json maps don't preserve.
+package jsonpage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OrderedPair represents a key-value pair with preserved order
+type OrderedPair struct {
+	Key   string
+	Value interface{}
+}
+
+// ContentItem represents the content inside the ID object with preserved order
+type ContentItem struct {
+	ID      string
+	Content []OrderedPair
+	// When is the item's "_when" condition; the item only renders when it holds
+	When string
+	// Tag is the item's wrapper element from "_tag", "div" when empty
+	Tag string
+}
+
+// Parser turns content JSON into content items. The zero value uses "p" for scalar
+// roots, warns about nothing, accepts any "_tag" and drops $include items.
+type Parser struct {
+	// ScalarTag is the tag scalar roots and scalar array elements render with
+	ScalarTag string
+	// Strict makes a duplicate key an error instead of a warning
+	Strict bool
+	// ItemTag reports whether an item's "_tag" may be its wrapper element
+	ItemTag func(tag string) bool
+	// Include returns the items that replace the item id, an object holding a string
+	// "$include", such as another file's items
+	Include func(id string, directive map[string]interface{}) ([]ContentItem, error)
+	// Warnf logs a problem the parser works around
+	Warnf func(format string, args ...interface{})
+}
+
+// ErrTrailingData is returned for content after the top-level value
+var ErrTrailingData = errors.New("invalid data after top-level value")
+
+// DuplicateKeyError reports a key given twice in one object, which encoding/json
+// silently resolves to the last value
+type DuplicateKeyError struct {
+	ID  string
+	Key string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("duplicate key %q in %s", e.Key, e.ID)
+}
+
+// RefError reports a $ref in the item ID that names a missing definition or a cycle
+type RefError struct {
+	ID  string
+	Err error
+}
+
+func (e *RefError) Error() string {
+	return fmt.Sprintf("%s: %v", e.ID, e.Err)
+}
+
+func (e *RefError) Unwrap() error {
+	return e.Err
+}
+
+// ParseOrderedJSON parses JSON while preserving the order of keys, with the zero Parser
+func ParseOrderedJSON(data []byte) ([]ContentItem, error) {
+	var p Parser
+	return p.Parse(data)
+}
+
+// Decode is json.Unmarshal with numbers kept as json.Number, so large integers and
+// decimals render exactly as written instead of going through float64
+func Decode(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// Parse builds the content items of a content file. An object root's members are
+// items in file order, skipping "flags" and "_defs"; the elements of an array root
+// are items numbered from 1, and a scalar root is a single item.
+func (p *Parser) Parse(data []byte) ([]ContentItem, error) {
+	// First, parse normally to get the data
+	var root interface{}
+	if err := Decode(data, &root); err != nil {
+		return nil, err
+	}
+	jsonData, ok := root.(map[string]interface{})
+	if !ok {
+		return p.parseNonObjectRoot(data, root)
+	}
+
+	// Extract the order of keys from the raw JSON
+	keyOrder := ExtractJSONKeyOrder(string(data))
+
+	// Build content items in order
+	var contentItems []ContentItem
+	seen := make(map[string]bool)
+	for _, topKey := range keyOrder {
+		if seen[topKey] {
+			if err := p.duplicateKey("the root object", topKey); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		seen[topKey] = true
+		if topKey == "flags" || topKey == "_defs" {
+			continue
+		}
+
+		if contentMap, ok := jsonData[topKey].(map[string]interface{}); ok {
+			// {"$include": "partials/header.json"} splices in another file's items
+			if _, ok := contentMap["$include"].(string); ok {
+				if p.Include == nil {
+					continue
+				}
+				included, err := p.Include(topKey, contentMap)
+				if err != nil {
+					return nil, err
+				}
+				contentItems = append(contentItems, included...)
+				continue
+			}
+
+			// {"$ref": "_defs/cta"} values are replaced by the shared definition
+			defs, _ := jsonData["_defs"].(map[string]interface{})
+			if _, err := ResolveRefs(contentMap, defs, nil); err != nil {
+				return nil, &RefError{ID: topKey, Err: err}
+			}
+
+			// Get the order of keys within this content item
+			innerKeyOrder := ExtractInnerKeyOrder(string(data), topKey)
+			item, err := p.objectItem(topKey, innerKeyOrder, contentMap)
+			if err != nil {
+				return nil, err
+			}
+			orderNested(item.Content, RawMember(string(data), topKey))
+			contentItems = append(contentItems, item)
+		}
+	}
+
+	return contentItems, nil
+}
+
+// parseNonObjectRoot builds content items for a document whose root isn't an object.
+// Each element of an array root becomes its own item with a synthesized ID, and a
+// scalar root becomes a single item.
+func (p *Parser) parseNonObjectRoot(data []byte, root interface{}) ([]ContentItem, error) {
+	elements, ok := root.([]interface{})
+	if !ok {
+		if root == nil {
+			return nil, nil
+		}
+		return []ContentItem{p.valueItem("1", root)}, nil
+	}
+
+	// Keep the raw elements around to recover the key order of object elements
+	var rawElements []json.RawMessage
+	if err := json.Unmarshal(data, &rawElements); err != nil {
+		return nil, err
+	}
+
+	var contentItems []ContentItem
+	for i, element := range elements {
+		item, ok, err := p.ElementItem(strconv.Itoa(i+1), element, rawElements[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			contentItems = append(contentItems, item)
+		}
+	}
+
+	return contentItems, nil
+}
+
+// ElementItem builds the item id from element, a decoded array element or JSON Lines
+// line whose JSON text is raw. ok is false for a null element, which has no item.
+func (p *Parser) ElementItem(id string, element interface{}, raw []byte) (item ContentItem, ok bool, err error) {
+	contentMap, isObject := element.(map[string]interface{})
+	if !isObject {
+		if element == nil {
+			return ContentItem{}, false, nil
+		}
+		return p.valueItem(id, element), true, nil
+	}
+	item, err = p.objectItem(id, ExtractJSONKeyOrder(string(raw)), contentMap)
+	if err != nil {
+		return ContentItem{}, false, err
+	}
+	orderNested(item.Content, string(raw))
+	return item, true, nil
+}
+
+// objectItem builds a content item from an object's keys in keyOrder. The reserved
+// "_when" key becomes the item's condition instead of a tag.
+func (p *Parser) objectItem(id string, keyOrder []string, contentMap map[string]interface{}) (ContentItem, error) {
+	item := ContentItem{ID: id}
+	seen := make(map[string]bool)
+	for _, key := range keyOrder {
+		value, exists := contentMap[key]
+		if !exists {
+			continue
+		}
+		if seen[key] {
+			if err := p.duplicateKey(id, key); err != nil {
+				return ContentItem{}, err
+			}
+			continue
+		}
+		seen[key] = true
+		if key == "_when" {
+			item.When, _ = value.(string)
+			continue
+		}
+		if key == "_tag" {
+			tag, _ := value.(string)
+			if tag != "" && (p.ItemTag == nil || p.ItemTag(tag)) {
+				item.Tag = tag
+			} else {
+				p.warnf("ignoring _tag %q in %s; using div", fmt.Sprint(value), id)
+			}
+			continue
+		}
+		item.Content = append(item.Content, OrderedPair{Key: key, Value: value})
+	}
+	return item, nil
+}
+
+// valueItem wraps a bare value in a content item: arrays as a list, scalars in ScalarTag
+func (p *Parser) valueItem(id string, value interface{}) ContentItem {
+	tag := p.ScalarTag
+	if tag == "" {
+		tag = "p"
+	}
+	if _, ok := value.([]interface{}); ok {
+		tag = "ul"
+	}
+	return ContentItem{
+		ID:      id,
+		Content: []OrderedPair{{Key: tag, Value: value}},
+	}
+}
+
+// duplicateKey handles a repeated key in the object id: it's an error under Strict,
+// otherwise a warning and the key renders once, at its first position, with its last value
+func (p *Parser) duplicateKey(id, key string) error {
+	if p.Strict {
+		return &DuplicateKeyError{ID: id, Key: key}
+	}
+	p.warnf("duplicate key %q in %s; using its last value", key, id)
+	return nil
+}
+
+func (p *Parser) warnf(format string, args ...interface{}) {
+	if p.Warnf != nil {
+		p.Warnf(format, args...)
+	}
+}
+
+// landmarkTags may hold nested content: an object of tags, such as a nav's ul, that
+// renders inside the element in order. An object with "text" is a plain element.
+var landmarkTags = map[string]bool{"header": true, "nav": true, "main": true, "aside": true, "footer": true}
+
+// orderNested replaces the object values whose key order matters, a landmark's nested
+// content, a dl's terms and the object items of a ul or ol, with ordered pairs in the
+// key order of raw, the JSON text of the enclosing object
+func orderNested(content []OrderedPair, raw string) {
+	for i, pair := range content {
+		if list, ok := pair.Value.([]interface{}); ok && (pair.Key == "ul" || pair.Key == "ol") {
+			orderListItems(list, RawMember(raw, pair.Key))
+			continue
+		}
+		obj, ok := pair.Value.(map[string]interface{})
+		if !ok || (pair.Key != "dl" && (!landmarkTags[pair.Key] || obj["text"] != nil)) {
+			continue
+		}
+		inner := RawMember(raw, pair.Key)
+		nested := orderObject(obj, inner)
+		if pair.Key != "dl" {
+			orderNested(nested, inner)
+		}
+		content[i].Value = nested
+	}
+}
+
+// orderListItems converts the object items of a ul or ol, at any depth, into
+// []OrderedPair in the order they appear in raw, the list's JSON text
+func orderListItems(list []interface{}, raw string) {
+	var rawItems []json.RawMessage
+	json.Unmarshal([]byte(raw), &rawItems)
+	for i, li := range list {
+		var inner string
+		if i < len(rawItems) {
+			inner = string(rawItems[i])
+		}
+		switch v := li.(type) {
+		case []interface{}:
+			orderListItems(v, inner)
+		case map[string]interface{}:
+			nested := orderObject(v, inner)
+			orderNested(nested, inner)
+			list[i] = nested
+		}
+	}
+}
+
+// orderObject returns obj's members in the order they appear in raw, its JSON text
+func orderObject(obj map[string]interface{}, raw string) []OrderedPair {
+	var nested []OrderedPair
+	seen := make(map[string]bool)
+	for _, key := range ExtractJSONKeyOrder(raw) {
+		if value, ok := obj[key]; ok && !seen[key] {
+			seen[key] = true
+			nested = append(nested, OrderedPair{Key: key, Value: value})
+		}
+	}
+	// Keys that aren't in raw, such as those from a $ref, follow in sorted order
+	var rest []string
+	for key := range obj {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	for _, key := range rest {
+		nested = append(nested, OrderedPair{Key: key, Value: obj[key]})
+	}
+	return nested
+}
+
+// RawMember returns the JSON text of key's value in the object jsonStr, or "" if
+// there's no such key
+func RawMember(jsonStr string, key string) string {
+	decoder := json.NewDecoder(strings.NewReader(jsonStr))
+	decoder.Token()
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			break
+		}
+		if token == key {
+			return string(value)
+		}
+	}
+	return ""
+}
+
+// ResolveRefs replaces each {"$ref": "_defs/name"} in value with the named entry of
+// defs, resolving refs inside the definitions too. resolving holds the refs being
+// resolved, to catch definitions that refer back to themselves.
+func ResolveRefs(value interface{}, defs map[string]interface{}, resolving []string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if ref, ok := v["$ref"].(string); ok && len(v) == 1 {
+			for _, r := range resolving {
+				if r == ref {
+					return nil, fmt.Errorf("$ref cycle: %s", strings.Join(append(resolving, ref), " -> "))
+				}
+			}
+			target, err := lookupRef(ref, defs)
+			if err != nil {
+				return nil, err
+			}
+			return ResolveRefs(target, defs, append(resolving, ref))
+		}
+		for key, child := range v {
+			resolved, err := ResolveRefs(child, defs, resolving)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = resolved
+		}
+	case []interface{}:
+		for i, child := range v {
+			resolved, err := ResolveRefs(child, defs, resolving)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolved
+		}
+	}
+	return value, nil
+}
+
+// lookupRef finds the definition a $ref such as "_defs/cta" or "_defs/buttons/cta" names
+func lookupRef(ref string, defs map[string]interface{}) (interface{}, error) {
+	name := strings.TrimPrefix(ref, "_defs/")
+	if name == ref || name == "" {
+		return nil, fmt.Errorf("$ref %q must start with _defs/", ref)
+	}
+	var value interface{} = defs
+	for _, part := range strings.Split(name, "/") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("$ref %q not found in _defs", ref)
+		}
+		if value, ok = obj[part]; !ok {
+			return nil, fmt.Errorf("$ref %q not found in _defs", ref)
+		}
+	}
+	return value, nil
+}
+
+// ExtractJSONKeyOrder extracts the order of top-level keys from raw JSON
+func ExtractJSONKeyOrder(jsonStr string) []string {
+	var keys []string
+	decoder := json.NewDecoder(strings.NewReader(jsonStr))
+
+	// Read opening brace
+	decoder.Token()
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if key, ok := token.(string); ok {
+			keys = append(keys, key)
+			// Skip the value
+			var dummy interface{}
+			decoder.Decode(&dummy)
+		}
+	}
+
+	return keys
+}
+
+// ExtractInnerKeyOrder extracts the order of keys within a specific object
+func ExtractInnerKeyOrder(jsonStr string, objectKey string) []string {
+	var keys []string
+
+	// Find the object in the JSON string
+	// This is a simplified approach - look for "objectKey": {
+	searchStr := fmt.Sprintf("\"%s\":", objectKey)
+	idx := strings.Index(jsonStr, searchStr)
+	if idx == -1 {
+		return keys
+	}
+
+	// Find the opening brace after the key
+	startIdx := strings.Index(jsonStr[idx:], "{")
+	if startIdx == -1 {
+		return keys
+	}
+	startIdx += idx + 1
+
+	// Extract the substring for this object
+	braceCount := 1
+	endIdx := startIdx
+	for endIdx < len(jsonStr) && braceCount > 0 {
+		if jsonStr[endIdx] == '{' {
+			braceCount++
+		} else if jsonStr[endIdx] == '}' {
+			braceCount--
+		}
+		endIdx++
+	}
+
+	objectStr := jsonStr[startIdx : endIdx-1]
+
+	// Parse the keys from this substring
+	decoder := json.NewDecoder(strings.NewReader("{" + objectStr + "}"))
+	decoder.Token() // Read opening brace
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if key, ok := token.(string); ok {
+			keys = append(keys, key)
+			// Skip the value
+			var dummy interface{}
+			decoder.Decode(&dummy)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,190 @@
+package jsonpage
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseOrderedJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want []ContentItem
+	}{
+		{
+			name: "items and tags keep file order",
+			json: `{"b": {"p": "1", "h1": "2"}, "a": {"h2": "3"}}`,
+			want: []ContentItem{
+				{ID: "b", Content: []OrderedPair{{"p", "1"}, {"h1", "2"}}},
+				{ID: "a", Content: []OrderedPair{{"h2", "3"}}},
+			},
+		},
+		{
+			name: "flags and _defs aren't items",
+			json: `{"flags": {"title": "T"}, "_defs": {"x": "y"}, "a": {"p": "1"}}`,
+			want: []ContentItem{{ID: "a", Content: []OrderedPair{{"p", "1"}}}},
+		},
+		{
+			name: "_when and _tag",
+			json: `{"a": {"_when": "promo", "_tag": "section", "p": "1"}}`,
+			want: []ContentItem{{ID: "a", When: "promo", Tag: "section", Content: []OrderedPair{{"p", "1"}}}},
+		},
+		{
+			name: "array root",
+			json: `[{"h1": "A", "p": "b"}, "text", null, [1, 2]]`,
+			want: []ContentItem{
+				{ID: "1", Content: []OrderedPair{{"h1", "A"}, {"p", "b"}}},
+				{ID: "2", Content: []OrderedPair{{"p", "text"}}},
+				{ID: "4", Content: []OrderedPair{{"ul", []interface{}{json.Number("1"), json.Number("2")}}}},
+			},
+		},
+		{
+			name: "scalar root",
+			json: `12345678901234567890`,
+			want: []ContentItem{{ID: "1", Content: []OrderedPair{{"p", json.Number("12345678901234567890")}}}},
+		},
+		{
+			name: "null root",
+			json: `null`,
+			want: nil,
+		},
+		{
+			name: "landmark content is ordered",
+			json: `{"a": {"nav": {"ul": ["x"], "h2": "y"}}}`,
+			want: []ContentItem{{ID: "a", Content: []OrderedPair{
+				{"nav", []OrderedPair{{"ul", []interface{}{"x"}}, {"h2", "y"}}},
+			}}},
+		},
+		{
+			name: "list object items are ordered",
+			json: `{"a": {"ul": [{"p": "1", "h3": "2"}]}}`,
+			want: []ContentItem{{ID: "a", Content: []OrderedPair{
+				{"ul", []interface{}{[]OrderedPair{{"p", "1"}, {"h3", "2"}}}},
+			}}},
+		},
+		{
+			name: "$ref is resolved",
+			json: `{"_defs": {"cta": "Go"}, "a": {"p": {"$ref": "_defs/cta"}}}`,
+			want: []ContentItem{{ID: "a", Content: []OrderedPair{{"p", "Go"}}}},
+		},
+		{
+			name: "duplicate keys render once with the last value",
+			json: `{"a": {"p": "1", "h1": "2", "p": "3"}}`,
+			want: []ContentItem{{ID: "a", Content: []OrderedPair{{"p", "3"}, {"h1", "2"}}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseOrderedJSON([]byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		parser Parser
+		json   string
+		check  func(error) bool
+	}{
+		{"trailing data", Parser{}, `{"a": {}} x`, func(err error) bool { return errors.Is(err, ErrTrailingData) }},
+		{"strict duplicate", Parser{Strict: true}, `{"a": {"p": "1", "p": "2"}}`, func(err error) bool {
+			var dup *DuplicateKeyError
+			return errors.As(err, &dup) && dup.ID == "a" && dup.Key == "p"
+		}},
+		{"missing ref", Parser{}, `{"a": {"p": {"$ref": "_defs/nope"}}}`, func(err error) bool {
+			var ref *RefError
+			return errors.As(err, &ref) && ref.ID == "a"
+		}},
+		{"ref cycle", Parser{}, `{"_defs": {"x": {"$ref": "_defs/x"}}, "a": {"p": {"$ref": "_defs/x"}}}`, func(err error) bool {
+			var ref *RefError
+			return errors.As(err, &ref)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.parser.Parse([]byte(tt.json))
+			if err == nil || !tt.check(err) {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestParserHooks(t *testing.T) {
+	var warnings []string
+	p := Parser{
+		ScalarTag: "span",
+		ItemTag:   func(tag string) bool { return tag == "section" },
+		Include: func(id string, directive map[string]interface{}) ([]ContentItem, error) {
+			return []ContentItem{{ID: id + "-included", Content: []OrderedPair{{"p", directive["$include"]}}}}, nil
+		},
+		Warnf: func(format string, args ...interface{}) { warnings = append(warnings, format) },
+	}
+	got, err := p.Parse([]byte(`{"a": {"$include": "part.json"}, "b": {"_tag": "img", "p": "x"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ContentItem{
+		{ID: "a-included", Content: []OrderedPair{{"p", "part.json"}}},
+		{ID: "b", Content: []OrderedPair{{"p", "x"}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("got warnings %q, want one for the _tag", warnings)
+	}
+
+	got, err = p.Parse([]byte(`"hello"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Content[0].Key != "span" {
+		t.Errorf("scalar root rendered with %q, want span", got[0].Content[0].Key)
+	}
+}
+
+func TestExtractKeyOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		inner string
+		want  []string
+	}{
+		{"top level", `{"z": 1, "a": {"y": 2}, "m": [3]}`, "", []string{"z", "a", "m"}},
+		{"inner", `{"z": 1, "a": {"y": 2, "b": {"c": 3}, "x": 4}}`, "a", []string{"y", "b", "x"}},
+		{"missing inner", `{"z": 1}`, "a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			if tt.inner == "" {
+				got = ExtractJSONKeyOrder(tt.json)
+			} else {
+				got = ExtractInnerKeyOrder(tt.json, tt.inner)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRawMember(t *testing.T) {
+	raw := `{"a": {"b": [1, 2]}, "c": "d"}`
+	if got := RawMember(raw, "a"); got != `{"b": [1, 2]}` {
+		t.Errorf("RawMember(a) = %q", got)
+	}
+	if got := RawMember(raw, "x"); got != "" {
+		t.Errorf("RawMember(x) = %q, want empty", got)
+	}
+}
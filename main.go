@@ -1,511 +1,4777 @@
 package main
 
 import (
-	"crypto/md5"
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gkmzfk6um/JSON_Server/jsonpage"
 )
 
-// OrderedPair represents a key-value pair with preserved order
-type OrderedPair struct {
-	Key   string
-	Value interface{}
+// OrderedPair and ContentItem are the parsed content, defined in the jsonpage package
+type (
+	OrderedPair = jsonpage.OrderedPair
+	ContentItem = jsonpage.ContentItem
+)
+
+// embeddedFiles are the default templates and home page built into the binary, used
+// when components/*.html or index.json aren't on disk
+//
+//go:embed components/*.html index.json
+var embeddedFiles embed.FS
+
+// aiDesign is set from -ai-design and can be toggled at runtime through /_admin/ai-design
+var aiDesign atomic.Bool
+var adminToken string
+var checkImages bool
+var checkRemoteImages bool
+var scalarTag string
+var contentDir string
+var cspEnabled bool
+var watchFiles bool
+var cacheTemplates bool
+var assetMaxAge time.Duration
+var wrapperFile string
+var wrapperTemplate *template.Template
+var templateDelims string
+var includeFallback string
+
+// trailingSlash is the -trailing-slash policy for page URLs: "strip", "add", or "" to
+// serve /blog and /blog/ alike
+var trailingSlash string
+var strictMode bool
+var exportDir string
+var contentIndex bool
+var searchIndex bool
+var allowFileParam bool
+var allowPreview bool
+var rawJSON bool
+var serverTimingEnabled bool
+var designCmd string
+var jsonComments bool
+var baseURL string
+var maxFileSize int64
+var faviconFile string
+var checkContent bool
+var maxHeaderBytes int
+var siteAuth string
+var warnShadow bool
+var metricsEnabled bool
+var tlsCert string
+var tlsKey string
+var keepAlive bool
+
+// designCacheDir holds the generated designs, one UUID-named directory each
+var designCacheDir string
+
+// leftDelim and rightDelim are the Go template delimiters, changed with -template-delims
+var leftDelim, rightDelim = "{{", "}}"
+
+// standardTags are rendered as plain HTML elements when no template exists for them
+var standardTags = map[string]bool{
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"p": true, "div": true, "span": true, "ul": true, "ol": true, "li": true,
+	"img": true, "a": true, "button": true, "input": true, "form": true,
+	"table": true, "tr": true, "td": true, "th": true, "thead": true, "tbody": true,
+	"section": true, "article": true, "header": true, "footer": true, "nav": true,
+	"main": true, "aside": true, "figure": true, "figcaption": true,
 }
 
-// ContentItem represents the content inside the ID object with preserved order
-type ContentItem struct {
-	ID      string
-	Content []OrderedPair
+// tagNamePattern matches the element names flags.standardtags accepts, such as
+// "blockquote" or the custom element "my-widget"
+var tagNamePattern = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// isStandardTag reports whether tag renders as a plain HTML element: one of standardTags,
+// or a name the page adds in flags.standardtags, such as a web component
+func isStandardTag(tag string, flags map[string]interface{}) bool {
+	if standardTags[tag] {
+		return true
+	}
+	extra, _ := flags["standardtags"].([]interface{})
+	for _, name := range extra {
+		if name == tag && tagNamePattern.MatchString(tag) {
+			return true
+		}
+	}
+	return false
 }
 
-var aiDesign bool
-var templates *template.Template
+// langPattern matches BCP 47 style language tags such as "en", "pt-BR" or "zh-Hant-TW"
+var langPattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
 
-func serveFavicon(w http.ResponseWriter, r *http.Request) {
-	//adjust content type if you use .ico instead
-	w.Header().Set("Content-Type", "image/png")
+// cssLengthPattern matches the values flags.maxwidth accepts: none, or a CSS length
+// such as 1200px, 60rem or 90%
+var cssLengthPattern = regexp.MustCompile(`^(none|0|[0-9]+(\.[0-9]+)?(px|em|rem|%|vw|vh|ch|ex|cm|mm|in|pt|pc))$`)
+
+// charsets maps the encoding labels accepted in flags.charset to the name that's declared
+var charsets = map[string]string{
+	"utf-8":        "utf-8",
+	"utf8":         "utf-8",
+	"iso-8859-1":   "iso-8859-1",
+	"latin1":       "iso-8859-1",
+	"iso-8859-15":  "iso-8859-15",
+	"windows-1252": "windows-1252",
+	"cp1252":       "windows-1252",
+	"shift_jis":    "shift_jis",
+	"euc-jp":       "euc-jp",
+	"euc-kr":       "euc-kr",
+	"gbk":          "gbk",
+	"gb18030":      "gb18030",
+	"big5":         "big5",
+	"koi8-r":       "koi8-r",
+}
+
+// pageCharset is the charset declared for a page: flags.charset if it's a known label,
+// otherwise utf-8
+func pageCharset(flags map[string]interface{}) string {
+	label, ok := flags["charset"].(string)
+	if !ok {
+		return "utf-8"
+	}
+	charset, ok := charsets[strings.ToLower(strings.TrimSpace(label))]
+	if !ok {
+		fmt.Println("Ignoring unknown charset:", label)
+		return "utf-8"
+	}
+	return charset
+}
+
+// voidTags are standard tags that can't have content, so they can't wrap an item
+var voidTags = map[string]bool{"img": true, "input": true}
+
+// builtinTags aren't HTML elements but have a server-side renderer in renderHTML
+var builtinTags = map[string]bool{
+	"accordion":    true,
+	"bibliography": true,
+	"cite":         true,
+	"code":         true,
+	"dl":           true,
+	"pre":          true,
+	"progress":     true,
+	"svg":          true,
+}
 
-	data, err := ioutil.ReadFile("assets/favicon.png")
+// faviconTypes are the content types of the usual favicon formats
+var faviconTypes = map[string]string{
+	".ico": "image/x-icon",
+	".png": "image/png",
+	".svg": "image/svg+xml",
+}
+
+func serveFavicon(w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open(faviconFile)
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	if setCacheHeaders(w, r, info) {
+		return
+	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+	// Types for the common favicon formats, since .ico isn't in every system's MIME table.
+	// ServeContent types other files by extension or by sniffing.
+	if contentType, ok := faviconTypes[strings.ToLower(filepath.Ext(faviconFile))]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	// ServeContent handles HEAD, Range and If-Modified-Since
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
 }
 
-func main() {
-	flag.BoolVar(&aiDesign, "ai-design", false, "Enable AI design mode for enhanced styling")
-	flag.Parse()
+// serveHealth answers liveness probes without touching the content files
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
 
-	// Initial template parsing (default)
-	parseTemplates("")
+// metrics are the counters served at /metrics under -metrics
+var metrics = &serverMetrics{requests: make(map[int]uint64), renderBuckets: make([]uint64, len(renderBuckets))}
 
-	http.HandleFunc("/favicon.ico", serveFavicon)
-	http.Handle("/assets/", http.StripPrefix("/assets/",
-		http.FileServer(http.Dir("assets")),
-	))
+// renderBuckets are the upper bounds, in seconds, of the render duration histogram
+var renderBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
 
-	http.HandleFunc("/", handler)
+type serverMetrics struct {
+	mu            sync.Mutex
+	requests      map[int]uint64
+	renderBuckets []uint64
+	renderSum     float64
+	renderCount   uint64
 
-	fmt.Println("Server starting on http://localhost:8080")
-	if aiDesign {
-		fmt.Println("AI Design Mode: ENABLED")
-	}
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	templateHits     atomic.Uint64
+	templateMisses   atomic.Uint64
+	designsGenerated atomic.Uint64
 }
 
-func parseTemplates(customUUID string) {
-	var err error
-	// Always load default templates first
-	templates, err = template.ParseGlob("components/*.html")
-	if err != nil {
-		// It's okay if no default templates exist, but we should log it if it's an error other than no match
-		if !strings.Contains(err.Error(), "pattern matches no files") {
-			fmt.Println("Error parsing default templates:", err)
+// countRequest records a page response's status
+func (m *serverMetrics) countRequest(status int) {
+	m.mu.Lock()
+	m.requests[status]++
+	m.mu.Unlock()
+}
+
+// observeRender records how long rendering a page took
+func (m *serverMetrics) observeRender(d time.Duration) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range renderBuckets {
+		if seconds <= bound {
+			m.renderBuckets[i]++
 		}
 	}
+	m.renderSum += seconds
+	m.renderCount++
+}
 
-	// If a custom design is selected, load those templates on top (overriding defaults)
-	if customUUID != "" {
-		customPath := filepath.Join("components", "cached", customUUID, "*.html")
-		customTemplates, err := template.ParseGlob(customPath)
-		if err == nil {
-			// If we already have templates, we need to merge or replace.
-			// template.ParseGlob returns a *new* set.
-			// To override, we can just use the custom set, assuming it might contain all needed overrides.
-			// However, to support partial overrides, we should ideally parse into the existing set.
-			// But ParseGlob creates a new one.
-			// Strategy: Parse defaults, then parse custom into the SAME template instance?
-			// template.Must(templates.ParseGlob(customPath)) would work if templates is not nil.
-			if templates == nil {
-				templates = customTemplates
-			} else {
-				_, err = templates.ParseGlob(customPath)
-				if err != nil {
-					fmt.Println("Error merging custom templates:", err)
-				}
-			}
-		} else {
-			fmt.Println("Error parsing custom templates:", err)
-		}
+// statusRecorder remembers the status written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes flushes through, so a page's head still goes out early under -metrics
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	// Determine which JSON file to load
-	jsonFile := "index.json"
+// countRequests counts next's responses by status for /metrics
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		metrics.countRequest(recorder.status)
+	})
+}
+
+// serveMetrics writes the metrics in the Prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP jsonserver_requests_total Page requests by response status.")
+	fmt.Fprintln(w, "# TYPE jsonserver_requests_total counter")
+	statuses := make([]int, 0, len(metrics.requests))
+	for status := range metrics.requests {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "jsonserver_requests_total{status=\"%d\"} %d\n", status, metrics.requests[status])
+	}
+
+	fmt.Fprintln(w, "# HELP jsonserver_render_duration_seconds Time spent rendering pages.")
+	fmt.Fprintln(w, "# TYPE jsonserver_render_duration_seconds histogram")
+	for i, bound := range renderBuckets {
+		fmt.Fprintf(w, "jsonserver_render_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'f', -1, 64), metrics.renderBuckets[i])
+	}
+	fmt.Fprintf(w, "jsonserver_render_duration_seconds_bucket{le=\"+Inf\"} %d\n", metrics.renderCount)
+	fmt.Fprintf(w, "jsonserver_render_duration_seconds_sum %s\n", strconv.FormatFloat(metrics.renderSum, 'f', -1, 64))
+	fmt.Fprintf(w, "jsonserver_render_duration_seconds_count %d\n", metrics.renderCount)
 
-	// Check if the path is /index.something
-	if r.URL.Path != "/" {
-		if strings.HasPrefix(r.URL.Path, "/index.") {
-			// Extract the name after /index.
-			name := strings.TrimPrefix(r.URL.Path, "/index.")
-			if name != "" {
-				jsonFile = "index." + name + ".json"
+	fmt.Fprintln(w, "# HELP jsonserver_template_cache_hits_total Template set lookups served from the cache.")
+	fmt.Fprintln(w, "# TYPE jsonserver_template_cache_hits_total counter")
+	fmt.Fprintf(w, "jsonserver_template_cache_hits_total %d\n", metrics.templateHits.Load())
+	fmt.Fprintln(w, "# HELP jsonserver_template_cache_misses_total Template set lookups that parsed the templates.")
+	fmt.Fprintln(w, "# TYPE jsonserver_template_cache_misses_total counter")
+	fmt.Fprintf(w, "jsonserver_template_cache_misses_total %d\n", metrics.templateMisses.Load())
+	fmt.Fprintln(w, "# HELP jsonserver_designs_generated_total AI designs generated or regenerated.")
+	fmt.Fprintln(w, "# TYPE jsonserver_designs_generated_total counter")
+	fmt.Fprintf(w, "jsonserver_designs_generated_total %d\n", metrics.designsGenerated.Load())
+}
+
+// cacheAssets adds caching headers to the file server for dir, answering conditional
+// requests for unchanged files with 304
+func cacheAssets(dir string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filePath := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		if info, err := os.Stat(filePath); err == nil && !info.IsDir() {
+			if setCacheHeaders(w, r, info) {
+				return
 			}
-		} else {
-			http.NotFound(w, r)
-			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setCacheHeaders sets Cache-Control and an ETag derived from the file's mtime and size.
+// It reports whether the client's copy is current, in which case 304 has been sent.
+func setCacheHeaders(w http.ResponseWriter, r *http.Request, info os.FileInfo) bool {
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(assetMaxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
 		}
 	}
+	return false
+}
 
-	data, err := ioutil.ReadFile(jsonFile)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Could not read %s", jsonFile), http.StatusInternalServerError)
+// serveDesignAsset serves a cached design's stylesheet at /_designs/<uuid>/style.css.
+// The stylesheets are public, since pages link them; the listing needs the -admin-token.
+func serveDesignAsset(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/_designs/" {
+		requireAdmin(http.HandlerFunc(serveDesignList)).ServeHTTP(w, r)
 		return
 	}
 
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal(data, &jsonData); err != nil {
-		http.Error(w, "Could not parse index.json: "+err.Error(), http.StatusInternalServerError)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/_designs/"), "/")
+	if len(parts) == 2 && parts[1] == "regenerate" && isDesignUUID(parts[0]) {
+		requireAdmin(http.HandlerFunc(serveDesignRegenerate)).ServeHTTP(w, r)
+		return
+	}
+	if len(parts) != 2 || parts[1] != "style.css" || !isDesignUUID(parts[0]) {
+		http.NotFound(w, r)
 		return
 	}
 
-	// Extract flags (server-only)
-	var flags map[string]interface{}
-	var designPromptValue string
-	var designUUID string
+	data, err := ioutil.ReadFile(filepath.Join(designCacheDir, parts[0], "style.css"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
 
-	if flagsData, ok := jsonData["flags"]; ok {
-		if flagsMap, ok := flagsData.(map[string]interface{}); ok {
-			flags = flagsMap
-			// Check for designprompt in flags
-			if prompt, ok := flags["designprompt"]; ok {
-				designPromptValue = fmt.Sprintf("%v", prompt)
-				if aiDesign {
-					designUUID = getOrGenerateDesign(designPromptValue)
-					// Re-parse templates with the new design
-					parseTemplates(designUUID)
-				}
-			}
-		}
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Write(data)
+}
+
+// serveDesignRegenerate handles POST /_designs/<uuid>/regenerate, rewriting the design's
+// templates and stylesheet from its stored prompt
+func serveDesignRegenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Parse JSON to extract key order
-	contentItems, err := parseOrderedJSON(data)
+	uuid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/_designs/"), "/regenerate")
+	prompt, err := regenerateDesign(uuid)
 	if err != nil {
-		http.Error(w, "Could not parse JSON with order: "+err.Error(), http.StatusInternalServerError)
+		http.NotFound(w, r)
 		return
 	}
 
-	renderHTML(w, contentItems, flags)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(designEntry{UUID: uuid, Prompt: prompt})
 }
 
-// parseOrderedJSON parses JSON while preserving the order of keys
-func parseOrderedJSON(data []byte) ([]ContentItem, error) {
-	// First, parse normally to get the data
-	var jsonData map[string]interface{}
-	if err := json.Unmarshal(data, &jsonData); err != nil {
-		return nil, err
+// Listing endpoints return defaultListLimit entries unless ?limit= asks for more,
+// up to maxListLimit
+const defaultListLimit = 50
+const maxListLimit = 500
+
+// listPage reads the limit and offset query parameters of a listing request and returns
+// the bounds of the requested page within total entries
+func listPage(r *http.Request, total int) (limit, offset, start, end int) {
+	limit = defaultListLimit
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
 	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && n > 0 {
+		offset = n
+	}
+
+	start = offset
+	if start > total {
+		start = total
+	}
+	end = start + limit
+	if end > total {
+		end = total
+	}
+	return limit, offset, start, end
+}
 
-	// Extract the order of keys from the raw JSON
-	keyOrder := extractJSONKeyOrder(string(data))
+// designEntry is one cached design in the /_designs listing
+type designEntry struct {
+	UUID   string `json:"uuid"`
+	Prompt string `json:"prompt"`
+}
 
-	// Build content items in order
-	var contentItems []ContentItem
-	for _, topKey := range keyOrder {
-		if topKey == "flags" {
+// serveDesignList lists the cached designs and their prompts as JSON, a page at a time
+func serveDesignList(w http.ResponseWriter, r *http.Request) {
+	var designs []designEntry
+	files, _ := ioutil.ReadDir(designCacheDir)
+	for _, f := range files {
+		if !f.IsDir() {
 			continue
 		}
+		prompt, _ := ioutil.ReadFile(filepath.Join(designCacheDir, f.Name(), "prompt.txt"))
+		designs = append(designs, designEntry{UUID: f.Name(), Prompt: strings.TrimSpace(string(prompt))})
+	}
 
-		if contentMap, ok := jsonData[topKey].(map[string]interface{}); ok {
-			// Get the order of keys within this content item
-			innerKeyOrder := extractInnerKeyOrder(string(data), topKey)
+	limit, offset, start, end := listPage(r, len(designs))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   len(designs),
+		"limit":   limit,
+		"offset":  offset,
+		"designs": append([]designEntry{}, designs[start:end]...),
+	})
+}
 
-			var pairs []OrderedPair
-			for _, innerKey := range innerKeyOrder {
-				if value, exists := contentMap[innerKey]; exists {
-					pairs = append(pairs, OrderedPair{Key: innerKey, Value: value})
-				}
-			}
-			contentItems = append(contentItems, ContentItem{
-				ID:      topKey,
-				Content: pairs,
-			})
+// requireAdmin only lets requests bearing the -admin-token through. Without a token the
+// admin endpoints don't exist.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.NotFound(w, r)
+			return
 		}
-	}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	return contentItems, nil
+// pageCredentials returns the user:pass a page requires: its flags.auth, else -auth.
+// An empty result means the page is public.
+func pageCredentials(flags map[string]interface{}) string {
+	if auth, ok := flags["auth"].(string); ok && auth != "" {
+		return auth
+	}
+	return siteAuth
 }
 
-// extractJSONKeyOrder extracts the order of top-level keys from raw JSON
-func extractJSONKeyOrder(jsonStr string) []string {
-	var keys []string
-	decoder := json.NewDecoder(strings.NewReader(jsonStr))
+// authorized reports whether r carries Basic auth matching credentials, which is
+// always the case when credentials is empty
+func authorized(r *http.Request, credentials string) bool {
+	if credentials == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(credentials)) == 1
+}
 
-	// Read opening brace
-	decoder.Token()
+// requireAuth answers 401 with a Basic auth challenge and returns false unless r is
+// authorized for credentials
+func requireAuth(w http.ResponseWriter, r *http.Request, credentials string) bool {
+	if authorized(r, credentials) {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="JSON Server", charset="UTF-8"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
 
-	for decoder.More() {
-		token, err := decoder.Token()
+// serveAIDesignToggle reports AI design mode on GET and switches it with POST ?enabled=true|false
+func serveAIDesignToggle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
 		if err != nil {
-			break
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
 		}
-		if key, ok := token.(string); ok {
-			keys = append(keys, key)
-			// Skip the value
-			var dummy interface{}
-			decoder.Decode(&dummy)
+		aiDesign.Store(enabled)
+		if enabled {
+			fmt.Println("AI Design Mode: ENABLED")
+		} else {
+			fmt.Println("AI Design Mode: DISABLED")
 		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	return keys
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": aiDesign.Load()})
 }
 
-// extractInnerKeyOrder extracts the order of keys within a specific object
-func extractInnerKeyOrder(jsonStr string, objectKey string) []string {
-	var keys []string
-
-	// Find the object in the JSON string
-	// This is a simplified approach - look for "objectKey": {
-	searchStr := fmt.Sprintf("\"%s\":", objectKey)
-	idx := strings.Index(jsonStr, searchStr)
-	if idx == -1 {
-		return keys
+// isDesignUUID reports whether s looks like a cached design directory name
+func isDesignUUID(s string) bool {
+	if len(s) != 32 {
+		return false
 	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
 
-	// Find the opening brace after the key
-	startIdx := strings.Index(jsonStr[idx:], "{")
-	if startIdx == -1 {
-		return keys
+func main() {
+	var aiDesignFlag bool
+	flag.BoolVar(&aiDesignFlag, "ai-design", false, "Enable AI design mode for enhanced styling")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token for the /_admin endpoints, design regeneration and the /_designs listing; they are disabled without one")
+	flag.BoolVar(&checkImages, "check-images", false, "Check img references in all content files at startup")
+	flag.BoolVar(&checkRemoteImages, "check-remote-images", false, "With -check-images, also HEAD-check remote images")
+	flag.StringVar(&contentDir, "dir", ".", "Directory containing the JSON content files")
+	flag.BoolVar(&cspEnabled, "csp", false, "Send a Content-Security-Policy header and nonce inline scripts and styles")
+	flag.BoolVar(&watchFiles, "watch", false, "Watch template directories and reload changed templates in the background")
+	flag.BoolVar(&cacheTemplates, "cache-templates", false, "Parse each template set once on first use and never check its files again (production)")
+	flag.DurationVar(&assetMaxAge, "asset-max-age", time.Hour, "How long browsers may cache assets and the favicon")
+	flag.StringVar(&wrapperFile, "wrapper", "", "Template file wrapped around the rendered items instead of the full page (fragment mode)")
+	flag.StringVar(&templateDelims, "template-delims", "", `Go template delimiters as "left right", e.g. "[[ ]]", to leave {{ }} to frontend frameworks`)
+	flag.StringVar(&includeFallback, "include-fallback", "placeholder", `What a failed $include renders: "placeholder", "skip", or "error" to fail the request`)
+	flag.BoolVar(&strictMode, "strict", false, "Fail the request with a 500 when a template or include fails instead of rendering around it")
+	flag.StringVar(&exportDir, "export", "", "Render every content file to HTML under this directory and exit instead of serving")
+	flag.BoolVar(&searchIndex, "search", false, "Serve /_search, the index of public page text that flags.search boxes query")
+	flag.BoolVar(&contentIndex, "content-index", false, "Serve /_index, an HTML list of every content page (a development aid)")
+	flag.BoolVar(&allowFileParam, "allow-file-param", false, "Let ?file=path/to/page.json render any content file, for CMS previews")
+	flag.BoolVar(&rawJSON, "raw-json", false, "Serve /index.json and other content file paths as JSON, without flags, _defs or hidden items")
+	flag.BoolVar(&allowPreview, "allow-preview", false, "Serve POST /_preview?file=page.json, which renders the file with a JSON Merge Patch from the body applied")
+	flag.StringVar(&designCmd, "design-cmd", "", "Command that generates AI designs: gets the prompt on stdin and the design directory as its argument")
+	flag.BoolVar(&jsonComments, "jsonc", false, "Allow // and /* */ comments in content JSON files")
+	flag.StringVar(&baseURL, "base-url", "", "Public URL of the site for absolute links such as sitemap entries, e.g. https://example.com; /sitemap.xml is only served with it")
+	flag.Int64Var(&maxFileSize, "max-file-size", 10<<20, "Largest content file, in bytes, the server will read (includes too)")
+	flag.StringVar(&faviconFile, "favicon", "assets/favicon.png", "File served at /favicon.ico (.ico, .png or .svg)")
+	flag.BoolVar(&checkContent, "check", false, "Validate every content file and its templates, print a report and exit instead of serving")
+	flag.StringVar(&designCacheDir, "design-cache-dir", filepath.Join("components", "cached"), "Directory for generated AI designs, e.g. a writable volume")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file; with -tls-key the server speaks HTTPS and HTTP/2")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file for -tls-cert")
+	flag.BoolVar(&keepAlive, "keepalive", true, "Keep client connections open between requests")
+	flag.BoolVar(&serverTimingEnabled, "server-timing", false, "Send a Server-Timing header with the time spent reading, parsing, loading templates and rendering each page")
+	flag.BoolVar(&metricsEnabled, "metrics", false, "Serve Prometheus metrics at /metrics and count page requests")
+	flag.BoolVar(&warnShadow, "warn-shadow", false, "Log templates that replace a standard tag's rendering as warnings on stderr")
+	flag.StringVar(&siteAuth, "auth", "", "Require HTTP Basic auth with these user:pass credentials for every page")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "Largest request header, in bytes; larger requests get 431")
+	flag.StringVar(&trailingSlash, "trailing-slash", "", `Redirect page URLs to one canonical form: "strip" sends /blog/ to /blog, "add" sends /blog to /blog/`)
+	flag.StringVar(&scalarTag, "scalar-tag", "p", "Tag used to render content files whose JSON root is a scalar")
+	flag.Parse()
+	aiDesign.Store(aiDesignFlag)
+
+	if checkImages {
+		if missing := checkImageReferences(); missing > 0 {
+			fmt.Printf("Image check: %d missing image reference(s)\n", missing)
+		} else {
+			fmt.Println("Image check: all image references resolved")
+		}
 	}
-	startIdx += idx + 1
 
-	// Extract the substring for this object
-	braceCount := 1
-	endIdx := startIdx
-	for endIdx < len(jsonStr) && braceCount > 0 {
-		if jsonStr[endIdx] == '{' {
-			braceCount++
-		} else if jsonStr[endIdx] == '}' {
-			braceCount--
+	if templateDelims != "" {
+		delims := strings.Fields(templateDelims)
+		if len(delims) != 2 {
+			log.Fatal("-template-delims must be two delimiters separated by a space, e.g. \"[[ ]]\"")
 		}
-		endIdx++
+		leftDelim, rightDelim = delims[0], delims[1]
 	}
 
-	objectStr := jsonStr[startIdx : endIdx-1]
+	if trailingSlash != "" && trailingSlash != "strip" && trailingSlash != "add" {
+		log.Fatal(`-trailing-slash must be "strip" or "add"`)
+	}
 
-	// Parse the keys from this substring
-	decoder := json.NewDecoder(strings.NewReader("{" + objectStr + "}"))
-	decoder.Token() // Read opening brace
+	var err error
+	if siteFlags, err = loadSiteFlags(); err != nil {
+		log.Fatal("Error loading flags.json: ", err)
+	}
 
-	for decoder.More() {
-		token, err := decoder.Token()
+	if wrapperFile != "" {
+		wrapperTemplate, err = template.New(filepath.Base(wrapperFile)).Delims(leftDelim, rightDelim).Funcs(templateFuncs).ParseFiles(wrapperFile)
 		if err != nil {
-			break
-		}
-		if key, ok := token.(string); ok {
-			keys = append(keys, key)
-			// Skip the value
-			var dummy interface{}
-			decoder.Decode(&dummy)
+			log.Fatal("Error parsing wrapper template: ", err)
 		}
 	}
 
-	return keys
-}
+	// Initial template parsing (default)
+	loadTemplates(templateDirs("", ""))
 
-func getOrGenerateDesign(prompt string) string {
-	// 1. Check if prompt is a UUID (simple heuristic: length 32 hex)
-	// If it looks like a UUID and exists in cached, return it.
-	if len(prompt) == 32 {
-		if _, err := os.Stat(filepath.Join("components", "cached", prompt)); err == nil {
-			return prompt
+	if checkContent {
+		if failed := checkSite(); failed > 0 {
+			fmt.Printf("Check: %d file(s) failed\n", failed)
+			os.Exit(1)
 		}
+		fmt.Println("Check: all content files OK")
+		return
 	}
 
-	// 2. Check if we already have a generated design for this prompt
-	// We can hash the prompt to find a consistent folder, or search.
-	// Searching is safer if we want to avoid collisions or support manual UUIDs.
-	// For simplicity, let's search all folders in components/cached for a matching prompt.txt
-	cachedDir := filepath.Join("components", "cached")
-	files, _ := ioutil.ReadDir(cachedDir)
-	for _, f := range files {
-		if f.IsDir() {
-			promptPath := filepath.Join(cachedDir, f.Name(), "prompt.txt")
-			content, err := ioutil.ReadFile(promptPath)
-			if err == nil && strings.TrimSpace(string(content)) == strings.TrimSpace(prompt) {
-				return f.Name()
-			}
+	if exportDir != "" {
+		pages, failed := exportSite(exportDir)
+		if watchFiles {
+			// Keep the export up to date instead of exiting, even if some pages failed
+			fmt.Println("Export complete, watching for changes:", exportDir)
+			watchExport(exportDir, pages, time.Second)
 		}
+		if failed > 0 {
+			fmt.Printf("Export: %d file(s) failed\n", failed)
+			os.Exit(1)
+		}
+		fmt.Println("Export complete:", exportDir)
+		return
 	}
 
-	// 3. Generate new design
-	newUUID := generateUUID()
-	newDir := filepath.Join(cachedDir, newUUID)
-	if err := os.MkdirAll(newDir, 0755); err != nil {
-		fmt.Println("Error creating cache dir:", err)
-		return ""
+	if watchFiles && !cacheTemplates {
+		go watchTemplates(time.Second)
 	}
 
-	// Save prompt
-	ioutil.WriteFile(filepath.Join(newDir, "prompt.txt"), []byte(prompt), 0644)
+	// Requests with larger headers are answered with 431 by net/http itself
+	server := &http.Server{
+		Addr:           ":8080",
+		Handler:        buildMux(),
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(keepAlive)
 
-	// Generate templates based on keywords
-	generateTemplates(newDir, prompt)
+	// Under TLS, net/http negotiates HTTP/2 through ALPN on its own
+	useTLS := tlsCert != "" && tlsKey != ""
+	if !useTLS && (tlsCert != "" || tlsKey != "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if useTLS {
+		fmt.Println("Server starting on https://localhost:8080")
+		fmt.Println("Protocols: HTTP/2, HTTP/1.1")
+	} else {
+		fmt.Println("Server starting on http://localhost:8080")
+		fmt.Println("Protocols: HTTP/1.1")
+	}
+	if !keepAlive {
+		fmt.Println("Keep-alive: DISABLED")
+	}
+	if aiDesign.Load() {
+		fmt.Println("AI Design Mode: ENABLED")
+	}
+	if useTLS {
+		log.Fatal(server.ListenAndServeTLS(tlsCert, tlsKey))
+	}
+	log.Fatal(server.ListenAndServe())
+}
 
-	return newUUID
+// customRoute is an extra handler registered ahead of the built-in routes
+type customRoute struct {
+	Pattern string
+	Handler http.Handler
 }
 
-func generateTemplates(dir, prompt string) {
-	promptLower := strings.ToLower(prompt)
+var customRoutes []customRoute
 
-	// Default styles
-	bgColor := "#ffffff"
-	textColor := "#333333"
-	accentColor := "#3498db"
-	font := "sans-serif"
+// RegisterRoute adds a handler for pattern to the server's mux. Call it from an init
+// function in another file of this package to add APIs or webhooks without touching
+// main. Custom routes are registered before the built-in ones, so a pattern equal to a
+// built-in route (including "/") replaces it.
+func RegisterRoute(pattern string, h http.Handler) {
+	customRoutes = append(customRoutes, customRoute{Pattern: pattern, Handler: h})
+}
 
-	if strings.Contains(promptLower, "dark") {
-		bgColor = "#2c3e50"
-		textColor = "#ecf0f1"
-		accentColor = "#e74c3c"
+// buildMux returns the server's routes: custom routes first, then the built-in ones
+func buildMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	registered := make(map[string]bool)
+	handle := func(pattern string, h http.Handler) {
+		if registered[pattern] {
+			return
+		}
+		registered[pattern] = true
+		mux.Handle(pattern, h)
 	}
-	if strings.Contains(promptLower, "moody") {
-		bgColor = "#1a1a1a"
-		textColor = "#dcdcdc"
-		accentColor = "#8e44ad"
+
+	for _, route := range customRoutes {
+		handle(route.Pattern, route.Handler)
 	}
-	if strings.Contains(promptLower, "clean") {
-		font = "'Helvetica Neue', Helvetica, Arial, sans-serif"
+
+	handle("/favicon.ico", http.HandlerFunc(serveFavicon))
+	handle("/assets/", http.StripPrefix("/assets/",
+		cacheAssets("assets", http.FileServer(http.Dir("assets"))),
+	))
+
+	handle("/healthz", http.HandlerFunc(serveHealth))
+	handle("/_designs", requireAdmin(http.HandlerFunc(serveDesignList)))
+	handle("/_designs/", http.HandlerFunc(serveDesignAsset))
+	if searchIndex {
+		handle("/_search", http.HandlerFunc(serveSearchIndex))
 	}
-	if strings.Contains(promptLower, "serif") {
-		font = "Georgia, serif"
+	handle("/sitemap.xml", http.HandlerFunc(serveSitemap))
+	if contentIndex {
+		handle("/_index", http.HandlerFunc(serveContentIndex))
+	}
+	if allowPreview {
+		handle("/_preview", http.HandlerFunc(servePreview))
 	}
+	handle("/_admin/ai-design", requireAdmin(http.HandlerFunc(serveAIDesignToggle)))
 
-	// H1 Template
-	h1Content := fmt.Sprintf(`<h1 style="color: %s; font-family: %s; border-bottom: 2px solid %s;">{{.}}</h1>`, accentColor, font, accentColor)
-	ioutil.WriteFile(filepath.Join(dir, "h1.html"), []byte(h1Content), 0644)
+	if metricsEnabled {
+		handle("/metrics", http.HandlerFunc(serveMetrics))
+		handle("/", countRequests(http.HandlerFunc(handler)))
+	} else {
+		handle("/", http.HandlerFunc(handler))
+	}
 
-	// Div Template
-	divContent := fmt.Sprintf(`<div style="background: %s; color: %s; padding: 20px; border-radius: 8px; margin: 10px 0;">{{.}}</div>`, bgColor, textColor)
-	ioutil.WriteFile(filepath.Join(dir, "div.html"), []byte(divContent), 0644)
+	return mux
 }
 
-func generateUUID() string {
-	h := md5.New()
-	h.Write([]byte(fmt.Sprintf("%d", os.Getpid())))
-	return hex.EncodeToString(h.Sum(nil))
+// templateSet is a parsed template set, the directories it was layered from and the
+// signature of the files it was parsed from
+type templateSet struct {
+	Templates *template.Template
+	Dirs      []string
+	Signature string
 }
 
-func renderHTML(w http.ResponseWriter, items []ContentItem, flags map[string]interface{}) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-
-	htmlStart := `<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>JSON Server</title>
-`
+// templateCache holds the parsed template sets, keyed by their joined directories
+var templateCache = make(map[string]*templateSet)
+var templateCacheMu sync.Mutex
 
-	// Add CSS library if specified in flags
-	if cssLib, ok := flags["csslib"]; ok && cssLib != nil {
-		cssLibStr := fmt.Sprintf("%v", cssLib)
-		switch strings.ToLower(cssLibStr) {
-		case "bootstrap":
-			htmlStart += `    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/css/bootstrap.min.css" rel="stylesheet">
-    <script src="https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/js/bootstrap.bundle.min.js"></script>
-`
-		case "tailwind":
-			htmlStart += `    <script src="https://cdn.tailwindcss.com"></script>
-`
-		case "bulma":
-			htmlStart += `    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/bulma@0.9.4/css/bulma.min.css">
-`
-		case "materialize":
-			htmlStart += `    <link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/css/materialize.min.css">
-    <script src="https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/js/materialize.min.js"></script>
-`
+// templateDirs lists the directories a page's templates are layered from, each
+// overriding the ones before it: the defaults, the active design, then the page's own
+// components/<flags.templates> directory
+func templateDirs(designUUID, pageTemplates string) []string {
+	dirs := []string{"components"}
+	if designUUID != "" {
+		dirs = append(dirs, filepath.Join(designCacheDir, designUUID))
+	}
+	if pageTemplates != "" {
+		cleaned := path.Clean(pageTemplates)
+		if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			fmt.Println("Ignoring templates directory outside components:", pageTemplates)
+		} else {
+			dirs = append(dirs, filepath.Join("components", filepath.FromSlash(cleaned)))
 		}
 	}
+	return dirs
+}
 
-	htmlStart += `    <style>
-        body { font-family: sans-serif; line-height: 1.6; padding: 20px; max-width: 800px; margin: 0 auto; }
-        img { max-width: 100%; height: auto; }
-    </style>
-`
+// loadTemplates returns the template set layered from dirs, parsing it on first use.
+// Without -watch the files are restatted on every call and reparsed when they changed;
+// with -watch the background watcher invalidates changed sets instead. With
+// -cache-templates a set is never reparsed once loaded.
+func loadTemplates(dirs []string) *template.Template {
+	key := strings.Join(dirs, string(filepath.ListSeparator))
+	templateCacheMu.Lock()
+	cached, ok := templateCache[key]
+	templateCacheMu.Unlock()
 
-	// Collect non-standard tags (tags without templates and not standard HTML)
-	standardTags := map[string]bool{
-		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
-		"p": true, "div": true, "span": true, "ul": true, "ol": true, "li": true,
-		"img": true, "a": true, "button": true, "input": true, "form": true,
-		"table": true, "tr": true, "td": true, "th": true, "thead": true, "tbody": true,
-		"section": true, "article": true, "header": true, "footer": true, "nav": true,
-		"main": true, "aside": true, "figure": true, "figcaption": true,
+	if ok && (watchFiles || cacheTemplates) {
+		metrics.templateHits.Add(1)
+		return cached.Templates
 	}
+	signature := templateSignature(dirs)
+	if ok && cached.Signature == signature {
+		metrics.templateHits.Add(1)
+		return cached.Templates
+	}
+	metrics.templateMisses.Add(1)
 
-	nonStandardData := make(map[string]interface{})
-
-	// First pass: collect non-standard tags
-	for _, item := range items {
-		for _, pair := range item.Content {
-			tag := pair.Key
-			content := pair.Value
-
-			// Check if it's a standard tag or has a template
-			hasTemplate := false
-			if templates != nil {
-				if templates.Lookup(tag+".html") != nil || templates.Lookup(tag) != nil {
-					hasTemplate = true
-				}
-			}
+	set := &templateSet{Templates: parseTemplates(dirs), Dirs: dirs, Signature: signature}
+	templateCacheMu.Lock()
+	templateCache[key] = set
+	templateCacheMu.Unlock()
+	return set.Templates
+}
 
-			if !standardTags[tag] && !hasTemplate {
-				// Store in nonStandardData for JS injection
-				nonStandardData[tag] = content
+// invalidateTemplates drops every cached template set layered from dir
+func invalidateTemplates(dir string) {
+	templateCacheMu.Lock()
+	defer templateCacheMu.Unlock()
+	for key, cached := range templateCache {
+		for _, d := range cached.Dirs {
+			if d == dir {
+				delete(templateCache, key)
+				break
 			}
 		}
 	}
+}
 
-	// Inject non-standard data as JavaScript variables
-	if len(nonStandardData) > 0 {
-		htmlStart += `<script>
-        // Non-standard tag content accessible to client
-        var customContent = {};
-`
-		for tag, content := range nonStandardData {
-			jsonContent, _ := json.Marshal(content)
-			htmlStart += fmt.Sprintf("        customContent['%s'] = %s;\n", tag, string(jsonContent))
+// templateSignature summarizes the names, sizes and mtimes of the template files in
+// dirs, so an edit to any layer changes it. os.Stat follows symlinks, so edits to a
+// symlinked template's target count too.
+func templateSignature(dirs []string) string {
+	var signature strings.Builder
+	for _, dir := range dirs {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.html"))
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				fmt.Fprintf(&signature, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+			}
 		}
-		htmlStart += `    </script>
-`
 	}
+	return signature.String()
+}
 
-	if aiDesign {
-		htmlStart += ``
+// watchTemplates polls the template directories of every cached set and drops the
+// sets whose files changed, so the next request reparses them
+func watchTemplates(interval time.Duration) {
+	for range time.Tick(interval) {
+		dropChangedTemplates()
 	}
+}
 
-	htmlStart += `</head><body><div class="container">`
-	fmt.Fprint(w, htmlStart)
+// dropChangedTemplates drops the cached template sets whose files changed since they were parsed
+func dropChangedTemplates() {
+	templateCacheMu.Lock()
+	defer templateCacheMu.Unlock()
+	for key, cached := range templateCache {
+		if templateSignature(cached.Dirs) != cached.Signature {
+			delete(templateCache, key)
+			fmt.Println("Templates changed in", strings.Join(cached.Dirs, ", ")+", reloading")
+		}
+	}
+}
 
-	for _, item := range items {
-		// Wrap each numbered object in a div
-		fmt.Fprintf(w, "<div id='%s'>", item.ID)
+// templateFuncs are available in every template, e.g. {{upper .}},
+// {{. | formatDate "Jan 2, 2006"}} or {{. | truncate 80}}
+var templateFuncs = template.FuncMap{
+	"upper":      func(v interface{}) string { return strings.ToUpper(formatScalar(v)) },
+	"lower":      func(v interface{}) string { return strings.ToLower(formatScalar(v)) },
+	"title":      titleCase,
+	"formatDate": formatDate,
+	"truncate":   truncate,
+}
 
+// titleCase upper-cases the first letter of each word
+func titleCase(v interface{}) string {
+	words := strings.Fields(formatScalar(v))
+	for i, word := range words {
+		r, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(r)) + word[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+// formatDate formats a date in Go layout notation. The value may be an RFC 3339 time,
+// a YYYY-MM-DD date or a Unix timestamp in seconds; anything else is returned unchanged.
+func formatDate(layout string, v interface{}) string {
+	s := formatScalar(v)
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC().Format(layout)
+	}
+	for _, in := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(in, s); err == nil {
+			return t.Format(layout)
+		}
+	}
+	return s
+}
+
+// truncate shortens the text to at most n characters, ending it with "…" when cut
+func truncate(n int, v interface{}) string {
+	runes := []rune(formatScalar(v))
+	if n < 1 || len(runes) <= n {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:n-1])) + "…"
+}
+
+// parseTemplates parses the default templates in dirs[0], then each override directory
+// in turn on top of them
+func parseTemplates(dirs []string) *template.Template {
+	for _, dir := range dirs {
+		reportShadowedTags(dir)
+	}
+
+	// Always load default templates first
+	templates, err := template.New("").Delims(leftDelim, rightDelim).Funcs(templateFuncs).ParseGlob(filepath.Join(dirs[0], "*.html"))
+	if err != nil && strings.Contains(err.Error(), "pattern matches no files") {
+		// None on disk: use the defaults built into the binary
+		templates, err = template.New("").Delims(leftDelim, rightDelim).Funcs(templateFuncs).ParseFS(embeddedFiles, "components/*.html")
+	}
+	if err != nil {
+		// It's okay if no default templates exist, but we should log it if it's an error other than no match
+		if !strings.Contains(err.Error(), "pattern matches no files") {
+			fmt.Println("Error parsing default templates:", err)
+		}
+	}
+
+	// Load each override directory on top (overriding same-named templates)
+	for _, dir := range dirs[1:] {
+		customPath := filepath.Join(dir, "*.html")
+		customTemplates, err := template.New("").Delims(leftDelim, rightDelim).Funcs(templateFuncs).ParseGlob(customPath)
+		if err == nil {
+			// template.ParseGlob returns a *new* set, so to support partial overrides
+			// parse the custom templates into the existing set instead.
+			if templates == nil {
+				templates = customTemplates
+			} else {
+				_, err = templates.ParseGlob(customPath)
+				if err != nil {
+					fmt.Println("Error merging custom templates:", err)
+				}
+			}
+		} else {
+			fmt.Println("Error parsing custom templates:", err)
+		}
+	}
+	return templates
+}
+
+// reportShadowedTags logs the templates in dir that replace the built-in rendering of
+// a standard tag, such as components/p.html for every p. Designs are skipped, since
+// overriding the standard tags is what they're for.
+func reportShadowedTags(dir string) {
+	if strings.HasPrefix(dir, designCacheDir+string(filepath.Separator)) {
+		return
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.html"))
+	for _, file := range files {
+		tag := strings.TrimSuffix(filepath.Base(file), ".html")
+		if !standardTags[tag] && !builtinTags[tag] {
+			continue
+		}
+		message := fmt.Sprintf("template %s replaces the built-in rendering of every %q tag", file, tag)
+		if warnShadow {
+			log.Println("WARNING:", message)
+		} else {
+			fmt.Println("Note:", message)
+		}
+	}
+}
+
+// resolveRequestFile maps a request path to the content file serving it:
+//
+//	/                  -> index.json
+//	/index.about       -> index.about.json
+//	/blog/ or /blog    -> blog/index.json (when blog is a directory)
+//	/blog/index.about  -> blog/index.about.json
+//
+// Each of langs, in order, is tried first as a translation: with langs ["fr"],
+// /index.about tries index.about.fr.json before index.about.json.
+//
+// It returns the file relative to the content directory and its full path, and false
+// when the path escapes the content directory or no candidate file exists.
+func resolveRequestFile(urlPath string, langs []string) (string, string, bool) {
+	dir, base := path.Split(urlPath)
+	var stem string
+	switch {
+	case base == "" || base == "index.":
+		stem = dir + "index"
+	case strings.HasPrefix(base, "index."):
+		stem = dir + base
+	default:
+		// A path naming a directory serves that directory's index
+		stem = urlPath + "/index"
+	}
+	stem = strings.TrimPrefix(stem, "/")
+
+	var candidates []string
+	for _, lang := range langs {
+		candidates = append(candidates, stem+"."+lang+".json", stem+"."+lang+".jsonl")
+	}
+	candidates = append(candidates, stem+".json", stem+".jsonl")
+
+	for _, rel := range candidates {
+		fullPath, err := resolveContentPath(rel)
+		if err != nil {
+			return "", "", false
+		}
+		if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
+			return rel, fullPath, true
+		}
+	}
+	return "", "", false
+}
+
+// requestLanguages returns the languages to look for translated content files in,
+// most preferred first: ?lang=, then Accept-Language by quality. A regional tag such
+// as fr-CA is followed by its base language.
+func requestLanguages(r *http.Request) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var prefs []weighted
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		prefs = append(prefs, weighted{lang, 2})
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v := strings.TrimPrefix(strings.TrimSpace(param), "q="); v != param {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{fields[0], q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+
+	var langs []string
+	seen := make(map[string]bool)
+	add := func(lang string) {
+		// The language becomes part of a file name, so it has to be a plain tag
+		if langPattern.MatchString(lang) && !seen[lang] {
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+	for _, pref := range prefs {
+		add(pref.lang)
+		if i := strings.Index(pref.lang, "-"); i > 0 {
+			add(pref.lang[:i])
+		}
+	}
+	return langs
+}
+
+// serveRawJSON serves a content file's JSON, unrendered, under -raw-json. Only the files
+// the handler would render (index.json and index.<name>.json) are served this way, and
+// only their public part: flags, _defs and items whose _when doesn't hold are left out.
+// A page that sets flags.auth is never served raw.
+func serveRawJSON(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(path.Base(rel), "index.") {
+		http.NotFound(w, r)
+		return
+	}
+	fullPath, err := resolveContentPath(rel)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := readContentFile(fullPath)
+	if errors.Is(err, errFileTooLarge) {
+		http.Error(w, fmt.Sprintf("Could not read %s: %v", rel, err), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read %s", rel), http.StatusInternalServerError)
+		return
+	}
+	_, flags, err := loadPage(rel, data)
+	if err != nil {
+		if !requireAuth(w, r, siteAuth) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not parse %s: %v", rel, err), parseErrorStatus(err))
+		return
+	}
+	if _, ok := flags["auth"]; ok {
+		http.Error(w, "Password-protected pages aren't served as JSON", http.StatusForbidden)
+		return
+	}
+	if !requireAuth(w, r, siteAuth) {
+		return
+	}
+	public, err := publicJSON(data, r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse %s: %v", rel, err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeContent(w, r, rel, info.ModTime(), bytes.NewReader(public))
+}
+
+// publicJSON returns a content file's JSON without its server-only parts: the flags,
+// the _defs and the items whose _when condition doesn't hold for query. Items keep
+// their order.
+func publicJSON(data []byte, query url.Values) ([]byte, error) {
+	data = cleanJSON(data)
+	hidden := func(raw []byte) bool {
+		var item map[string]interface{}
+		if json.Unmarshal(raw, &item) != nil {
+			return false
+		}
+		when, _ := item["_when"].(string)
+		return when != "" && !conditionHolds(when, query)
+	}
+
+	var out []byte
+	members, isObject, err := objectMembers(data)
+	if err != nil {
+		return nil, err
+	}
+	var elements []json.RawMessage
+	switch {
+	case isObject:
+		var public []rawPair
+		for _, m := range members {
+			if m.Key != "flags" && m.Key != "_defs" && !hidden(m.Value) {
+				public = append(public, m)
+			}
+		}
+		out = encodeMembers(public)
+	case json.Unmarshal(data, &elements) == nil:
+		var public []json.RawMessage
+		for _, element := range elements {
+			if !hidden(element) {
+				public = append(public, element)
+			}
+		}
+		if out, err = json.Marshal(public); err != nil {
+			return nil, err
+		}
+	default:
+		out = data
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, out, "", "    "); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+// contentURL maps a content file back to the URL path serving it, the inverse of
+// resolveRequestFile
+func contentURL(file string) string {
+	rel, err := filepath.Rel(contentDir, file)
+	if err != nil {
+		rel = file
+	}
+	dir, name := path.Split(filepath.ToSlash(rel))
+	if name == "index.json" || name == "index.jsonl" {
+		return canonicalPath("/" + dir)
+	}
+	return "/" + dir + strings.TrimSuffix(name, path.Ext(name))
+}
+
+// canonicalPath applies the -trailing-slash policy to a page URL path. The root, paths
+// naming an index file such as /index.about and raw .json paths are left alone.
+func canonicalPath(urlPath string) string {
+	if urlPath == "/" || strings.HasSuffix(urlPath, ".json") {
+		return urlPath
+	}
+	switch trailingSlash {
+	case "strip":
+		if trimmed := strings.TrimRight(urlPath, "/"); trimmed != "" {
+			return trimmed
+		}
+	case "add":
+		if !strings.HasSuffix(urlPath, "/") && !strings.HasPrefix(path.Base(urlPath), "index.") {
+			return urlPath + "/"
+		}
+	}
+	return urlPath
+}
+
+// contentFiles returns the content files the handler can serve: index.json and
+// index.<name>.json, or .jsonl, in the content directory and its subdirectories
+func contentFiles() []string {
+	var files []string
+	filepath.Walk(contentDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if p != contentDir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(name)
+		if strings.HasPrefix(name, "index.") && (ext == ".json" || ext == ".jsonl") {
+			if checkContained(p) == nil {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	return files
+}
+
+// resolveContentPath joins a slash-separated path onto the content directory,
+// rejecting paths that would escape it
+func resolveContentPath(rel string) (string, error) {
+	cleaned := path.Clean(rel)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %q is outside the content directory", rel)
+	}
+
+	fullPath := filepath.Join(contentDir, filepath.FromSlash(cleaned))
+	if err := checkContained(fullPath); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+// checkContained returns an error when p, with symlinks resolved, lies outside the
+// content directory. Symlinks that stay inside it are fine. Paths that don't exist
+// pass, so callers report them as missing rather than forbidden.
+func checkContained(p string) error {
+	return checkContainedIn(contentDir, p)
+}
+
+// checkContainedIn is checkContained for the directory dir
+func checkContainedIn(dir, p string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	root, _ = filepath.Abs(root)
+	target, _ = filepath.Abs(target)
+	rel, err := filepath.Rel(root, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path %q resolves outside %s", p, dir)
+	}
+	return nil
+}
+
+// checkImageReferences scans every content file for img values and reports the ones
+// that don't resolve. It returns the number of missing images.
+func checkImageReferences() int {
+	missing := 0
+	for _, file := range contentFiles() {
+		data, err := readContentFile(file)
+		if err != nil {
+			fmt.Println("Image check: could not read", file+":", err)
+			continue
+		}
+		items, _, err := loadPage(file, data)
+		if err != nil {
+			fmt.Println("Image check: could not parse", file+":", err)
+			continue
+		}
+		for _, item := range items {
+			for _, pair := range item.Content {
+				if pair.Key != "img" {
+					continue
+				}
+				src := imageSource(pair.Value)
+				if problem := checkImageSource(src); problem != "" {
+					fmt.Printf("Image check: %s: item %q: img %q %s\n", file, item.ID, src, problem)
+					missing++
+				}
+			}
+		}
+	}
+	return missing
+}
+
+// imageSource returns the src of an img value, which is either the src itself or an
+// object of attributes
+func imageSource(value interface{}) string {
+	if obj, ok := value.(map[string]interface{}); ok {
+		value = obj["src"]
+	}
+	if value == nil {
+		return ""
+	}
+	return formatScalar(value)
+}
+
+// checkImageSource returns a description of the problem with src, or "" if it resolves
+func checkImageSource(src string) string {
+	if src == "" {
+		return "is empty"
+	}
+	if strings.HasPrefix(src, "data:") {
+		return ""
+	}
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "//") {
+		if !checkRemoteImages {
+			return ""
+		}
+		if strings.HasPrefix(src, "//") {
+			src = "https:" + src
+		}
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Head(src)
+		if err != nil {
+			return "could not be fetched: " + err.Error()
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return "returned " + resp.Status
+		}
+		return ""
+	}
+
+	localPath := imageLocalPath(src)
+	if _, err := os.Stat(localPath); err != nil {
+		return "not found at " + localPath
+	}
+	return ""
+}
+
+// imageLocalPath normalizes a local img src to the file it is served from,
+// e.g. "/assets/logo.png?v=2" becomes "assets/logo.png"
+func imageLocalPath(src string) string {
+	if i := strings.IndexAny(src, "?#"); i >= 0 {
+		src = src[:i]
+	}
+	cleaned := path.Clean("/" + src)
+	return filepath.FromSlash(strings.TrimPrefix(cleaned, "/"))
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	// Pages are read-only; for HEAD the server discards the body and keeps the headers
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// With -trailing-slash each page has one canonical URL and the other form redirects to it
+	if canonical := canonicalPath(r.URL.Path); canonical != r.URL.Path {
+		target := *r.URL
+		target.Path = canonical
+		http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	// Under -raw-json, /index.json and /docs/index.about.json serve the content file's JSON
+	if rawJSON && strings.HasSuffix(r.URL.Path, ".json") {
+		serveRawJSON(w, r)
+		return
+	}
+
+	// Determine which JSON file to load
+	jsonFile, fullPath, ok := resolveRequestFile(r.URL.Path, requestLanguages(r))
+	w.Header().Set("Vary", "Accept-Language")
+	if file := r.URL.Query().Get("file"); file != "" && allowFileParam {
+		// Previews: ?file=drafts/homepage.json renders that content file at any path
+		jsonFile = file
+		var err error
+		fullPath, err = resolveContentPath(file)
+		ok = err == nil && (path.Ext(file) == ".json" || path.Ext(file) == ".jsonl")
+		if ok {
+			if info, statErr := os.Stat(fullPath); statErr != nil || info.IsDir() {
+				ok = false
+			}
+		}
+	}
+	var timing *serverTiming
+	if serverTimingEnabled {
+		timing = &serverTiming{}
+	}
+
+	// .jsonl pages are read a line at a time, and streamed when nothing needs every item first
+	if ok && path.Ext(jsonFile) == ".jsonl" {
+		serveJSONLines(w, r, jsonFile, fullPath, timing)
+		return
+	}
+
+	// Without an index.json on disk, the home page falls back to the built-in one
+	var data []byte
+	var err error
+	if !ok && r.URL.Path == "/" {
+		jsonFile = "index.json"
+		data, err = embeddedFiles.ReadFile("index.json")
+		ok = err == nil
+	} else if ok {
+		start := time.Now()
+		data, err = readContentFile(fullPath)
+		timing.since("read", "File read", start)
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, errFileTooLarge) {
+		http.Error(w, fmt.Sprintf("Could not read %s: %v", jsonFile, err), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read %s", jsonFile), http.StatusInternalServerError)
+		return
+	}
+
+	contentItems, flags, err := loadPageTimed(jsonFile, data, timing)
+	if err != nil {
+		// Without the page's flags, only -auth can guard the error details
+		if !requireAuth(w, r, siteAuth) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not parse %s: %v", jsonFile, err), parseErrorStatus(err))
+		return
+	}
+	servePage(w, r, contentItems, flags, timing)
+}
+
+// servePage responds with a parsed page once its credentials check out: the items whose
+// _when holds, with placeholders filled in, as HTML or as the plain-text dump
+func servePage(w http.ResponseWriter, r *http.Request, contentItems []ContentItem, flags map[string]interface{}, timing *serverTiming) {
+	if !requireAuth(w, r, pageCredentials(flags)) {
+		return
+	}
+	contentItems = visibleItems(contentItems, r.URL.Query())
+	contentItems = interpolateItems(contentItems, r.URL.Query(), flags)
+	setPageHeaders(w, flags)
+
+	w.Header().Add("Vary", "Accept")
+	if wantsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeTextPage(w, contentItems)
+		return
+	}
+
+	start := time.Now()
+	ctx := pageContext(flags)
+	timing.since("templates", "Template resolution", start)
+	ctx.Timing = timing
+	renderHTML(w, contentItems, flags, ctx)
+}
+
+// serveJSONLines serves a .jsonl page from the file at fullPath, decoding it a line at a
+// time. Unless the page needs every item first (see canStream), the head is sent once
+// the first item is read, and each item is rendered and flushed as its line is decoded.
+func serveJSONLines(w http.ResponseWriter, r *http.Request, jsonFile, fullPath string, timing *serverTiming) {
+	start := time.Now()
+	f, err := openContentFile(fullPath)
+	timing.since("read", "File open", start)
+	if errors.Is(err, errFileTooLarge) {
+		http.Error(w, fmt.Sprintf("Could not read %s: %v", jsonFile, err), http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read %s", jsonFile), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// The flags lines come before the first item, so by then the page's flags are known
+	start = time.Now()
+	lines := newJSONLines(f, maxFileSize)
+	var contentItems []ContentItem
+	item, ok, err := lines.next()
+	if ok {
+		contentItems = append(contentItems, item)
+	}
+	flags := lines.flags()
+	stream := err == nil && ok && canStream(r, flags)
+	if err == nil && !stream {
+		contentItems, err = lines.readAll(contentItems)
+	}
+	timing.since("parse", "JSON parse", start)
+	if err != nil {
+		// Without the page's flags, only -auth can guard the error details
+		if !requireAuth(w, r, siteAuth) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not parse %s: %v", jsonFile, err), parseErrorStatus(err))
+		return
+	}
+	if !stream {
+		servePage(w, r, sortItems(contentItems, flags), flags, timing)
+		return
+	}
+
+	if !requireAuth(w, r, pageCredentials(flags)) {
+		return
+	}
+	query := r.URL.Query()
+	contentItems = interpolateItems(visibleItems(contentItems, query), query, flags)
+	setPageHeaders(w, flags)
+	w.Header().Add("Vary", "Accept")
+
+	ctx := pageContext(flags)
+	ctx.More = func() (ContentItem, bool, error) {
+		for {
+			item, ok, err := lines.next()
+			if err != nil || !ok {
+				return item, ok, err
+			}
+			if visible := visibleItems([]ContentItem{item}, query); len(visible) > 0 {
+				return interpolateItems(visible, query, flags)[0], true, nil
+			}
+		}
+	}
+	renderHTML(w, contentItems, flags, ctx)
+}
+
+// canStream reports whether a .jsonl page can be sent as its lines are read. It can't
+// when the response is buffered anyway, under -strict, -server-timing or -wrapper, for
+// the text dump, or when the order, copy-link anchors or citation numbers of the items
+// depend on all of them.
+func canStream(r *http.Request, flags map[string]interface{}) bool {
+	if strictMode || serverTimingEnabled || wrapperTemplate != nil || wantsPlainText(r) {
+		return false
+	}
+	if order, _ := flags["sort"].(string); order != "" && order != "file" {
+		return false
+	}
+	copyLinks, _ := flags["copylinks"].(bool)
+	_, bibliography := flags["bibliography"]
+	return !copyLinks && !bibliography
+}
+
+// wantsPlainText reports whether the request asks for the text dump of a page, with
+// ?format=text or an Accept header preferring text/plain to text/html
+func wantsPlainText(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "text"
+	}
+	plainQ, htmlQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v := strings.TrimPrefix(strings.TrimSpace(param), "q="); v != param {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(fields[0])) {
+		case "text/plain":
+			plainQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+	return plainQ > 0 && plainQ > htmlQ
+}
+
+// htmlTagPattern matches the markup writeTextPage strips from values
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// writeTextPage writes items as "ID: tag = value" lines in order, with HTML stripped
+// and whitespace collapsed, for scripts and diffs. Nested landmark content shows as
+// dotted tags such as "nav.ul".
+func writeTextPage(w io.Writer, items []ContentItem) {
+	out := bufio.NewWriter(w)
+	for _, item := range items {
+		writeTextPairs(out, item.ID, "", item.Content)
+	}
+	out.Flush()
+}
+
+func writeTextPairs(w io.Writer, id, prefix string, pairs []OrderedPair) {
+	for _, pair := range pairs {
+		if nested, ok := pair.Value.([]OrderedPair); ok {
+			writeTextPairs(w, id, prefix+pair.Key+".", nested)
+			continue
+		}
+		text := html.UnescapeString(htmlTagPattern.ReplaceAllString(formatScalar(pair.Value), ""))
+		fmt.Fprintf(w, "%s: %s%s = %s\n", id, prefix, pair.Key, strings.Join(strings.Fields(text), " "))
+	}
+}
+
+// serverTiming collects how long a request's phases took for the -server-timing
+// header. Its methods do nothing on a nil *serverTiming, so callers needn't check.
+type serverTiming struct {
+	entries []string
+}
+
+// since records the time elapsed since start as the metric name
+func (t *serverTiming) since(name, desc string, start time.Time) {
+	if t == nil {
+		return
+	}
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	t.entries = append(t.entries, fmt.Sprintf("%s;desc=%q;dur=%.3f", name, desc, ms))
+}
+
+// header returns the Server-Timing header value
+func (t *serverTiming) header() string {
+	return strings.Join(t.entries, ", ")
+}
+
+// parseErrorStatus is the response status for a loadPage error. Malformed JSON, duplicate
+// keys and late .jsonl flags (only errors under -strict) are content mistakes, not
+// server faults.
+func parseErrorStatus(err error) int {
+	var dup *jsonpage.DuplicateKeyError
+	var ref *jsonpage.RefError
+	if isMalformedJSON(err) {
+		return http.StatusBadRequest
+	} else if errors.As(err, &dup) || errors.As(err, &ref) || errors.Is(err, errLateFlags) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+// servePreview handles POST /_preview?file=page.json under -allow-preview: it applies
+// the request body, a JSON Merge Patch (RFC 7386), to the content file in memory and
+// renders the result, so a CMS can show unsaved edits. Nothing is written to disk.
+func servePreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file := r.URL.Query().Get("file")
+	// A merge patch describes one JSON document, and a .jsonl file is one per line
+	if path.Ext(file) == ".jsonl" {
+		http.Error(w, "Preview doesn't apply to .jsonl files: a JSON Merge Patch patches a single JSON document", http.StatusBadRequest)
+		return
+	}
+	fullPath, err := resolveContentPath(file)
+	if err != nil || path.Ext(file) != ".json" {
+		http.Error(w, "?file must name a .json file inside the content directory", http.StatusBadRequest)
+		return
+	}
+	data, err := readContentFile(fullPath)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read %s: %v", file, err), http.StatusInternalServerError)
+		return
+	}
+
+	// The saved page decides who may preview it, so a patch can't drop its flags.auth
+	_, baseFlags, err := loadPage(file, data)
+	if err != nil {
+		if !requireAuth(w, r, siteAuth) {
+			return
+		}
+		http.Error(w, fmt.Sprintf("Could not parse %s: %v", file, err), parseErrorStatus(err))
+		return
+	}
+	if !requireAuth(w, r, pageCredentials(baseFlags)) {
+		return
+	}
+
+	patch, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFileSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not read the patch: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	patch = bytes.TrimPrefix(patch, utf8BOM)
+	if !json.Valid(patch) {
+		http.Error(w, "The patch is not valid JSON", http.StatusBadRequest)
+		return
+	}
+	merged, err := mergePatch(cleanJSON(data), patch)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not apply the patch: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	contentItems, flags, err := loadPage(file, merged)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Could not parse the patched %s: %v", file, err), parseErrorStatus(err))
+		return
+	}
+	contentItems = visibleItems(contentItems, r.URL.Query())
+	contentItems = interpolateItems(contentItems, r.URL.Query(), flags)
+	setPageHeaders(w, flags)
+	w.Header().Set("Cache-Control", "no-store")
+
+	renderHTML(w, contentItems, flags, pageContext(flags))
+}
+
+// rawPair is an object member whose value is left as JSON text
+type rawPair struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// mergePatch applies the JSON Merge Patch patch to target, both JSON text, following
+// RFC 7386: object members merge recursively, null removes a member, and anything else
+// replaces the target. Members keep their order in target; new ones go at the end.
+func mergePatch(target, patch []byte) ([]byte, error) {
+	patchMembers, ok, err := objectMembers(patch)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return patch, nil
+	}
+	members, ok, err := objectMembers(target)
+	if err != nil || !ok {
+		members = nil
+	}
+
+	for _, pm := range patchMembers {
+		i := 0
+		for i < len(members) && members[i].Key != pm.Key {
+			i++
+		}
+		if string(bytes.TrimSpace(pm.Value)) == "null" {
+			if i < len(members) {
+				members = append(members[:i], members[i+1:]...)
+			}
+			continue
+		}
+		var old []byte
+		if i < len(members) {
+			old = members[i].Value
+		}
+		value, err := mergePatch(old, pm.Value)
+		if err != nil {
+			return nil, err
+		}
+		if i < len(members) {
+			members[i].Value = value
+		} else {
+			members = append(members, rawPair{Key: pm.Key, Value: value})
+		}
+	}
+
+	return encodeMembers(members), nil
+}
+
+// encodeMembers writes members as a JSON object, in order
+func encodeMembers(members []rawPair) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.Key)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(m.Value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
+
+// objectMembers returns the members of the JSON object data in order. ok is false
+// when data isn't an object.
+func objectMembers(data []byte) ([]rawPair, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, false, err
+	}
+	if delim, isDelim := token.(json.Delim); !isDelim || delim != '{' {
+		return nil, false, nil
+	}
+	var members []rawPair
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, false, err
+		}
+		members = append(members, rawPair{Key: token.(string), Value: value})
+	}
+	return members, true, nil
+}
+
+// protectedHeaders can't be set from flags.headers; the server manages them itself
+var protectedHeaders = map[string]bool{
+	"Connection": true, "Content-Encoding": true, "Content-Length": true,
+	"Content-Security-Policy": true, "Content-Type": true, "Trailer": true,
+	"Transfer-Encoding": true, "Upgrade": true,
+}
+
+// headerNamePattern matches valid HTTP header names
+var headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// setPageHeaders applies the page's flags.headers, e.g. {"X-Frame-Options": "SAMEORIGIN"},
+// skipping protected and malformed headers
+func setPageHeaders(w http.ResponseWriter, flags map[string]interface{}) {
+	headers, _ := flags["headers"].(map[string]interface{})
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(name)
+		if protectedHeaders[name] || !headerNamePattern.MatchString(name) {
+			fmt.Println("Ignoring header from flags:", name)
+			continue
+		}
+		v := formatScalar(value)
+		if strings.ContainsAny(v, "\r\n") {
+			fmt.Println("Ignoring header from flags:", name)
+			continue
+		}
+		w.Header().Set(name, v)
+	}
+}
+
+// errFileTooLarge is returned for content files over -max-file-size
+var errFileTooLarge = errors.New("file exceeds -max-file-size")
+
+// readContentFile reads a content file, refusing files over -max-file-size so a huge
+// file can't exhaust memory
+func readContentFile(name string) ([]byte, error) {
+	f, err := openContentFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The limit also holds if the file grows while it's read
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxFileSize {
+		return nil, fmt.Errorf("%w (limit %d bytes)", errFileTooLarge, maxFileSize)
+	}
+	return data, nil
+}
+
+// openContentFile opens a content file, refusing files over -max-file-size
+func openContentFile(name string) (*os.File, error) {
+	if readRecorder != nil {
+		readRecorder(name)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > maxFileSize {
+		f.Close()
+		return nil, fmt.Errorf("%w (%d bytes, limit %d)", errFileTooLarge, info.Size(), maxFileSize)
+	}
+	return f, nil
+}
+
+// loadPage parses a content file into its items, in file order, and its flags. name
+// is only used for its extension: .jsonl files hold one item per line.
+func loadPage(name string, data []byte) ([]ContentItem, map[string]interface{}, error) {
+	return loadPageTimed(name, data, nil)
+}
+
+// loadPageTimed is loadPage recording the JSON parse and key order extraction in timing
+func loadPageTimed(name string, data []byte, timing *serverTiming) ([]ContentItem, map[string]interface{}, error) {
+	start := time.Now()
+	if path.Ext(name) == ".jsonl" {
+		contentItems, flags, err := loadJSONLines(data)
+		timing.since("parse", "JSON parse", start)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sortItems(contentItems, flags), flags, nil
+	}
+	var root interface{}
+	if err := decodeJSON(data, &root); err != nil {
+		return nil, nil, syntaxErrorPosition(data, err)
+	}
+	// Only an object root can carry flags; arrays and scalars are rendered as-is
+	jsonData, _ := root.(map[string]interface{})
+
+	// Extract flags (server-only), over the site-wide defaults from flags.json
+	pageFlags, _ := jsonData["flags"].(map[string]interface{})
+	flags := mergeFlags(siteFlags, pageFlags)
+
+	timing.since("parse", "JSON parse", start)
+
+	// Parse JSON to extract key order
+	start = time.Now()
+	contentItems, err := parseOrderedJSON(data)
+	timing.since("order", "Key order extraction", start)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sortItems(contentItems, flags), flags, nil
+}
+
+// numericIDPattern matches the IDs flags.sort "numeric" orders by value, such as "7" or "-1.5"
+var numericIDPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// numericID returns id's value when it's a number
+func numericID(id string) (float64, bool) {
+	if !numericIDPattern.MatchString(id) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(id, 64)
+	return f, err == nil
+}
+
+// sortItems orders items by flags.sort: "file" (the default) keeps the file's order,
+// "alpha" sorts by ID, and "numeric" sorts numeric IDs by value, so "2" comes before
+// "10", followed by any other IDs alphabetically
+func sortItems(items []ContentItem, flags map[string]interface{}) []ContentItem {
+	order, _ := flags["sort"].(string)
+	switch order {
+	case "", "file":
+	case "alpha":
+		sort.SliceStable(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	case "numeric":
+		sort.SliceStable(items, func(i, j int) bool {
+			a, okA := numericID(items[i].ID)
+			b, okB := numericID(items[j].ID)
+			switch {
+			case okA && okB:
+				return a < b
+			case okA || okB:
+				return okA
+			}
+			return items[i].ID < items[j].ID
+		})
+	default:
+		fmt.Println("Ignoring unknown sort:", order)
+	}
+	return items
+}
+
+// loadJSONLines parses a JSON Lines content file held in data into its items and flags.
+// Each line is an item, numbered like the elements of an array root; see jsonLines.
+func loadJSONLines(data []byte) ([]ContentItem, map[string]interface{}, error) {
+	lines := newJSONLines(bytes.NewReader(data), int64(len(data)))
+	contentItems, err := lines.readAll(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return contentItems, lines.flags(), nil
+}
+
+// jsonLines reads a JSON Lines content file a line at a time, so the file is never held
+// whole and no single value spans the feed. Lines holding only {"flags": {...}} set the
+// page's flags. They come before the first item, since a streamed page's head is sent
+// by then; a later one is ignored with a warning, or is an error under -strict.
+type jsonLines struct {
+	scanner   *bufio.Scanner
+	limited   *io.LimitedReader
+	parser    jsonpage.Parser
+	pageFlags map[string]interface{}
+	line      int
+	items     int
+}
+
+// errLateFlags is returned under -strict for a flags line after the first item
+var errLateFlags = errors.New("flags must come before the first item")
+
+// newJSONLines reads the lines of r, failing with errFileTooLarge past limit bytes
+func newJSONLines(r io.Reader, limit int64) *jsonLines {
+	limited := &io.LimitedReader{R: r, N: limit + 1}
+	scanner := bufio.NewScanner(limited)
+	scanner.Buffer(nil, int(limit)+1)
+	return &jsonLines{scanner: scanner, limited: limited, parser: contentParser(nil)}
+}
+
+// next returns the next item, numbered from 1. ok is false at the end of the file.
+func (l *jsonLines) next() (item ContentItem, ok bool, err error) {
+	for l.scanner.Scan() {
+		l.line++
+		line := cleanJSON(l.scanner.Bytes())
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var element interface{}
+		if err := decodeJSON(line, &element); err != nil {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return ContentItem{}, false, fmt.Errorf("line %d, column %d: %w", l.line, syntaxErr.Offset, err)
+			}
+			return ContentItem{}, false, fmt.Errorf("line %d: %w", l.line, err)
+		}
+
+		contentMap, isObject := element.(map[string]interface{})
+		if flags, isFlags := contentMap["flags"].(map[string]interface{}); isObject && isFlags && len(contentMap) == 1 {
+			if l.items == 0 {
+				l.pageFlags = mergeFlags(l.pageFlags, flags)
+			} else if strictMode {
+				return ContentItem{}, false, fmt.Errorf("line %d: %w", l.line, errLateFlags)
+			} else {
+				fmt.Printf("Warning: ignoring the flags on line %d, after the first item\n", l.line)
+			}
+			continue
+		}
+		item, ok, err := l.parser.ElementItem(strconv.Itoa(l.items+1), element, line)
+		if err != nil {
+			return ContentItem{}, false, err
+		}
+		if ok {
+			l.items++
+			return item, true, nil
+		}
+	}
+	if l.limited.N == 0 || errors.Is(l.scanner.Err(), bufio.ErrTooLong) {
+		return ContentItem{}, false, fmt.Errorf("%w (limit %d bytes)", errFileTooLarge, maxFileSize)
+	}
+	return ContentItem{}, false, l.scanner.Err()
+}
+
+// readAll appends the remaining items to items
+func (l *jsonLines) readAll(items []ContentItem) ([]ContentItem, error) {
+	for {
+		item, ok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return items, nil
+		}
+		items = append(items, item)
+	}
+}
+
+// flags returns the page's flags over the site-wide defaults
+func (l *jsonLines) flags() map[string]interface{} {
+	return mergeFlags(siteFlags, l.pageFlags)
+}
+
+// siteFlags are the site-wide default flags from the content directory's flags.json
+var siteFlags map[string]interface{}
+
+// loadSiteFlags reads flags.json from the content directory, if there is one
+func loadSiteFlags() (map[string]interface{}, error) {
+	fullPath, err := resolveContentPath("flags.json")
+	if err != nil {
+		return nil, err
+	}
+	data, err := readContentFile(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var flags map[string]interface{}
+	if err := decodeJSON(data, &flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// mergeFlags returns the site flags overridden key by key by the page's own flags
+func mergeFlags(site, page map[string]interface{}) map[string]interface{} {
+	if len(site) == 0 {
+		return page
+	}
+	merged := make(map[string]interface{}, len(site)+len(page))
+	for key, value := range site {
+		merged[key] = value
+	}
+	for key, value := range page {
+		merged[key] = value
+	}
+	return merged
+}
+
+// checkSite parses and renders every content file the way -strict would, reporting
+// files that fail and tags that have neither an element, a renderer nor a template (they
+// are injected into customContent for scripts). It returns the number of failed files.
+// AI designs aren't generated, so only the default and page templates are checked.
+func checkSite() int {
+	strictMode = true
+	failed := 0
+	for _, file := range contentFiles() {
+		rel, err := filepath.Rel(contentDir, file)
+		if err != nil {
+			rel = file
+		}
+		if err := checkPage(file, rel); err != nil {
+			fmt.Printf("FAIL %s: %v\n", rel, err)
+			failed++
+			continue
+		}
+		fmt.Println("ok  ", rel)
+	}
+	return failed
+}
+
+// checkPage validates one content file, printing its unresolved tags
+func checkPage(file, rel string) error {
+	data, err := readContentFile(file)
+	if err != nil {
+		return err
+	}
+	items, flags, err := loadPage(file, data)
+	if err != nil {
+		return err
+	}
+
+	pageTemplates, _ := flags["templates"].(string)
+	if pageTemplates != "" {
+		if info, err := os.Stat(filepath.Join("components", filepath.FromSlash(pageTemplates))); err != nil || !info.IsDir() {
+			return fmt.Errorf("templates directory components/%s not found", pageTemplates)
+		}
+	}
+	ctx := renderContext{Templates: loadTemplates(templateDirs("", pageTemplates))}
+
+	unresolved := make(map[string]bool)
+	for _, item := range items {
+		for _, pair := range item.Content {
+			tag := pair.Key
+			if isStandardTag(tag, flags) || builtinTags[tag] || unresolved[tag] {
+				continue
+			}
+			if tagTemplate(ctx.Templates, tag) != nil {
+				continue
+			}
+			unresolved[tag] = true
+			fmt.Printf("     %s: tag %q has no template; it is only available to scripts as customContent\n", rel, tag)
+		}
+	}
+
+	return renderPage(ioutil.Discard, items, flags, ctx)
+}
+
+// exportSite renders every content file to a .html file under outDir, mirroring the
+// content directory (blog/index.json becomes blog/index.html), and copies the assets and
+// the stylesheets of the designs in use. It returns the exported pages by content file
+// and the number of files that failed.
+func exportSite(outDir string) (map[string]*exportedPage, int) {
+	failed := 0
+	pages := make(map[string]*exportedPage)
+	designs := make(map[string]bool)
+	for _, file := range contentFiles() {
+		page, err := exportPage(file, outDir)
+		pages[file] = page
+		if err != nil {
+			fmt.Printf("Export failed for %s: %v\n", page.Rel, err)
+			failed++
+			continue
+		}
+		if page.DesignUUID != "" {
+			designs[page.DesignUUID] = true
+		}
+		fmt.Println("Exported", page.Rel, "->", page.Out)
+	}
+
+	if err := copyDir("assets", filepath.Join(outDir, "assets")); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Export failed copying assets:", err)
+		failed++
+	}
+	for uuid := range designs {
+		if err := copyDesignStyle(outDir, uuid); err != nil {
+			fmt.Println("Export failed copying design stylesheet:", err)
+			failed++
+		}
+	}
+	return pages, failed
+}
+
+// exportedPage is a page written by -export, with the files it was built from so
+// -export -watch can tell when it needs rebuilding
+type exportedPage struct {
+	Rel        string
+	Out        string
+	DesignUUID string
+	// Files are the content files read for the page: its own, includes and bibliography
+	Files []string
+	// Dirs are the template directories the page was rendered with
+	Dirs              []string
+	Signature         string
+	TemplateSignature string
+}
+
+// readRecorder, when set, is called with every content file read, including missing ones
+var readRecorder func(name string)
+
+// exportPage renders the content file at file to its .html file under outDir. The
+// returned page is filled in as far as rendering got, even on error. There's no
+// request, so items conditioned on a query parameter are left out.
+func exportPage(file, outDir string) (*exportedPage, error) {
+	rel, err := filepath.Rel(contentDir, file)
+	if err != nil {
+		rel = file
+	}
+	page := &exportedPage{Rel: rel, Out: filepath.Join(outDir, strings.TrimSuffix(rel, filepath.Ext(rel))+".html")}
+	readRecorder = func(name string) { page.Files = append(page.Files, name) }
+	defer func() {
+		readRecorder = nil
+		page.Signature = fileSignature(page.Files)
+		page.TemplateSignature = templateSignature(page.Dirs)
+	}()
+
+	data, err := readContentFile(file)
+	if err != nil {
+		return page, err
+	}
+	items, flags, err := loadPage(file, data)
+	if err != nil {
+		return page, err
+	}
+	ctx := pageContext(flags)
+	pageTemplates, _ := flags["templates"].(string)
+	page.DesignUUID = ctx.DesignUUID
+	page.Dirs = templateDirs(ctx.DesignUUID, pageTemplates)
+
+	var out bytes.Buffer
+	items = interpolateItems(visibleItems(items, url.Values{}), url.Values{}, flags)
+	if err := renderPage(&out, items, flags, ctx); err != nil {
+		return page, err
+	}
+	if err := os.MkdirAll(filepath.Dir(page.Out), 0755); err != nil {
+		return page, err
+	}
+	return page, ioutil.WriteFile(page.Out, out.Bytes(), 0644)
+}
+
+// copyDesignStyle copies a design's stylesheet into the export, if it has one
+func copyDesignStyle(outDir, uuid string) error {
+	src := filepath.Join(designCacheDir, uuid, "style.css")
+	err := copyFile(src, filepath.Join(outDir, "_designs", uuid, "style.css"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// fileSignature summarizes the sizes and mtimes of files, like templateSignature
+func fileSignature(files []string) string {
+	var signature strings.Builder
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&signature, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(&signature, "%s:missing;", file)
+		}
+	}
+	return signature.String()
+}
+
+// watchExport polls the files behind each exported page and re-exports only the pages
+// whose content, includes or templates changed, plus new content files. A change to
+// flags.json reloads the site-wide flags and rebuilds every page.
+func watchExport(outDir string, pages map[string]*exportedPage, interval time.Duration) {
+	flagsFile, _ := resolveContentPath("flags.json")
+	flagsSignature := fileSignature([]string{flagsFile})
+	for range time.Tick(interval) {
+		rebuildAll := false
+		if signature := fileSignature([]string{flagsFile}); signature != flagsSignature {
+			flagsSignature = signature
+			flags, err := loadSiteFlags()
+			if err != nil {
+				fmt.Println("Could not reload site flags:", err)
+				continue
+			}
+			siteFlags = flags
+			rebuildAll = true
+		}
+
+		current := make(map[string]bool)
+		for _, file := range contentFiles() {
+			current[file] = true
+		}
+		for file, page := range pages {
+			if !current[file] {
+				fmt.Println("No longer exporting removed", page.Rel)
+				delete(pages, file)
+			}
+		}
+		for file := range current {
+			page, ok := pages[file]
+			templatesChanged := ok && templateSignature(page.Dirs) != page.TemplateSignature
+			if ok && !rebuildAll && !templatesChanged && fileSignature(page.Files) == page.Signature {
+				continue
+			}
+			if templatesChanged {
+				for _, dir := range page.Dirs {
+					invalidateTemplates(dir)
+				}
+			}
+			page, err := exportPage(file, outDir)
+			pages[file] = page
+			if err != nil {
+				fmt.Printf("Export failed for %s: %v\n", page.Rel, err)
+				continue
+			}
+			if page.DesignUUID != "" {
+				if err := copyDesignStyle(outDir, page.DesignUUID); err != nil {
+					fmt.Println("Export failed copying design stylesheet:", err)
+				}
+			}
+			fmt.Println("Rebuilt", page.Rel, "->", page.Out)
+		}
+	}
+}
+
+// copyDir copies the files under src to dst, creating directories as needed
+func copyDir(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		return copyFile(p, filepath.Join(dst, rel))
+	})
+}
+
+// copyFile copies src to dst, creating dst's directory as needed
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// utf8BOM is the byte order mark some Windows editors put at the start of UTF-8 files
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// cleanJSON prepares content file bytes for parsing: it drops a leading BOM, which
+// encoding/json rejects, and under -jsonc the comments
+func cleanJSON(data []byte) []byte {
+	return stripComments(bytes.TrimPrefix(data, utf8BOM))
+}
+
+// stripComments blanks out // and /* */ comments under -jsonc, leaving string values,
+// including URLs with //, untouched. Without -jsonc data is returned as is.
+func stripComments(data []byte) []byte {
+	if !jsonComments || !bytes.Contains(data, []byte("/")) {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out = append(out, c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end == -1 {
+				i = len(data)
+			} else {
+				i += end + 3
+			}
+			out = append(out, ' ')
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// decodeJSON is json.Unmarshal with numbers kept as json.Number, so large integers
+// and decimals render exactly as written instead of going through float64
+func decodeJSON(data []byte, v interface{}) error {
+	return jsonpage.Decode(cleanJSON(data), v)
+}
+
+// isMalformedJSON reports whether err comes from invalid JSON syntax in a content file
+func isMalformedJSON(err error) bool {
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &syntaxErr) || errors.Is(err, jsonpage.ErrTrailingData) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// syntaxErrorPosition adds the line and column of a *json.SyntaxError to err
+func syntaxErrorPosition(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return err
+	}
+	// The decoder's offset counts from the cleaned text
+	data = cleanJSON(data)
+	offset := int(syntaxErr.Offset)
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	column := offset - bytes.LastIndexByte(data[:offset], '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+// parseOrderedJSON parses JSON while preserving the order of keys
+func parseOrderedJSON(data []byte) ([]ContentItem, error) {
+	return parseOrderedJSONIncluding(data, nil)
+}
+
+// parseOrderedJSONIncluding is parseOrderedJSON for a file reached through the chain of
+// $include directives in including, which is used to detect include cycles
+func parseOrderedJSONIncluding(data []byte, including []string) ([]ContentItem, error) {
+	parser := contentParser(including)
+	// The key order is read from the raw text, so it needs the BOM and comments gone too
+	return parser.Parse(cleanJSON(data))
+}
+
+// contentParser is the jsonpage parser set up from the command-line flags, for a file
+// reached through the $include chain in including
+func contentParser(including []string) jsonpage.Parser {
+	return jsonpage.Parser{
+		ScalarTag: scalarTag,
+		Strict:    strictMode,
+		ItemTag:   func(tag string) bool { return standardTags[tag] && !voidTags[tag] },
+		Include: func(id string, directive map[string]interface{}) ([]ContentItem, error) {
+			includePath, _ := directive["$include"].(string)
+			included, err := expandInclude(includePath, including)
+			if err != nil {
+				fallback, _ := directive["$fallback"].(string)
+				return includeFallbackItems(id, fallback, err)
+			}
+			return included, nil
+		},
+		Warnf: func(format string, args ...interface{}) {
+			fmt.Printf("Warning: "+format+"\n", args...)
+		},
+	}
+}
+
+// expandInclude parses the content file at includePath, relative to the content
+// directory, into content items, following any includes it contains in turn
+func expandInclude(includePath string, including []string) ([]ContentItem, error) {
+	fullPath, err := resolveContentPath(includePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not include %s: %v", includePath, err)
+	}
+	for _, p := range including {
+		if p == fullPath {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(including, fullPath), " -> "))
+		}
+	}
+
+	data, err := readContentFile(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not include %s: %v", includePath, err)
+	}
+	return parseOrderedJSONIncluding(data, append(including, fullPath))
+}
+
+// defaultIncludePlaceholder is shown in place of an include that could not be read
+const defaultIncludePlaceholder = "This content is currently unavailable."
+
+// includeFallbackItems decides what replaces a failed include. fallback is the include's
+// "$fallback" value, defaulting to -include-fallback: "skip" drops it, "error" fails the
+// request with err, "placeholder" renders a generic notice and any other text renders
+// that text instead.
+func includeFallbackItems(id, fallback string, err error) ([]ContentItem, error) {
+	if strictMode {
+		return nil, err
+	}
+	if fallback == "" {
+		fallback = includeFallback
+	}
+	switch fallback {
+	case "error":
+		return nil, err
+	case "skip":
+		fmt.Println("Skipping include:", err)
+		return nil, nil
+	case "placeholder":
+		fallback = defaultIncludePlaceholder
+	}
+	fmt.Println("Rendering include placeholder:", err)
+	return []ContentItem{{
+		ID:      id,
+		Content: []OrderedPair{{Key: "p", Value: map[string]interface{}{"text": fallback, "class": "include-fallback"}}},
+	}}, nil
+}
+
+// visibleItems drops the items whose "_when" condition doesn't hold. A condition names
+// a query parameter ("promo" renders with ?promo=1) or, prefixed with "env:", an
+// environment variable ("env:HOLIDAY"). Either counts as set unless empty, "0" or
+// "false"; a leading "!" negates the condition.
+func visibleItems(items []ContentItem, query url.Values) []ContentItem {
+	var visible []ContentItem
+	for _, item := range items {
+		if item.When == "" || conditionHolds(item.When, query) {
+			visible = append(visible, item)
+		}
+	}
+	return visible
+}
+
+// placeholderPattern matches {{env "NAME"}} and {{query "name"}} in string values
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(env|query)\s+"([^"]*)"\s*\}\}`)
+
+// interpolateItems replaces {{env "NAME"}} and {{query "name"}} placeholders in the
+// items' string values with the environment variable or query parameter. Unknown
+// names become empty; an unset environment variable is logged once.
+func interpolateItems(items []ContentItem, query url.Values, flags map[string]interface{}) []ContentItem {
+	// Normal rendering escapes the text, substituted values included. With flags.rawhtml
+	// the text is written as is, so the substituted values are escaped here instead.
+	escapeValues, _ := flags["rawhtml"].(bool)
+	for i := range items {
+		for j := range items[i].Content {
+			items[i].Content[j].Value = interpolateValue(items[i].Content[j].Value, query, escapeValues)
+		}
+	}
+	return items
+}
+
+// warnedEnv holds the unset environment variables already logged, so a placeholder
+// warns once rather than on every request
+var warnedEnv sync.Map
+
+func interpolateValue(value interface{}, query url.Values, escapeValues bool) interface{} {
+	switch v := value.(type) {
+	case string:
+		if !strings.Contains(v, "{{") {
+			return v
+		}
+		return placeholderPattern.ReplaceAllStringFunc(v, func(m string) string {
+			parts := placeholderPattern.FindStringSubmatch(m)
+			var s string
+			if parts[1] == "env" {
+				var ok bool
+				if s, ok = os.LookupEnv(parts[2]); !ok {
+					if _, warned := warnedEnv.LoadOrStore(parts[2], true); !warned {
+						fmt.Printf("Warning: unknown env variable %q in content\n", parts[2])
+					}
+				}
+			} else {
+				// A missing query parameter is up to the visitor, so it isn't logged
+				s = query.Get(parts[2])
+			}
+			if escapeValues {
+				s = template.HTMLEscapeString(s)
+			}
+			return s
+		})
+	case []interface{}:
+		for i := range v {
+			v[i] = interpolateValue(v[i], query, escapeValues)
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = interpolateValue(v[key], query, escapeValues)
+		}
+	case []OrderedPair:
+		for i := range v {
+			v[i].Value = interpolateValue(v[i].Value, query, escapeValues)
+		}
+	}
+	return value
+}
+
+func conditionHolds(condition string, query url.Values) bool {
+	negate := strings.HasPrefix(condition, "!")
+	condition = strings.TrimSpace(strings.TrimPrefix(condition, "!"))
+
+	var value string
+	if name := strings.TrimPrefix(condition, "env:"); name != condition {
+		value = os.Getenv(name)
+	} else {
+		value = query.Get(condition)
+	}
+	set := value != "" && value != "0" && strings.ToLower(value) != "false"
+	return set != negate
+}
+
+// designIndex maps trimmed prompts to the UUID of their cached design, so cache hits
+// skip the directory scan
+var designIndex sync.Map
+
+// designLocks holds a *sync.Mutex per prompt so a new design is generated only once,
+// even when several requests for the same prompt arrive together
+var designLocks sync.Map
+
+func getOrGenerateDesign(prompt string) string {
+	key := strings.TrimSpace(prompt)
+	if uuid, ok := designIndex.Load(key); ok {
+		return uuid.(string)
+	}
+
+	// Only one request per prompt scans or generates; the others wait and reuse its result
+	lock, _ := designLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if uuid, ok := designIndex.Load(key); ok {
+		return uuid.(string)
+	}
+
+	uuid := findOrGenerateDesign(prompt)
+	if uuid != "" {
+		designIndex.Store(key, uuid)
+	}
+	return uuid
+}
+
+// findOrGenerateDesign returns the cached design for prompt, generating it if needed
+func findOrGenerateDesign(prompt string) string {
+	// 1. Check if prompt is a UUID (simple heuristic: length 32 hex)
+	// If it looks like a UUID and exists in cached, return it.
+	if len(prompt) == 32 {
+		if _, err := os.Stat(filepath.Join(designCacheDir, prompt)); err == nil {
+			return prompt
+		}
+	}
+
+	// 2. Check if we already have a generated design for this prompt
+	// We can hash the prompt to find a consistent folder, or search.
+	// Searching is safer if we want to avoid collisions or support manual UUIDs.
+	// For simplicity, let's search all folders in the design cache for a matching prompt.txt
+	cachedDir := designCacheDir
+	files, _ := ioutil.ReadDir(cachedDir)
+	for _, f := range files {
+		if f.IsDir() {
+			promptPath := filepath.Join(cachedDir, f.Name(), "prompt.txt")
+			content, err := ioutil.ReadFile(promptPath)
+			if err == nil && strings.TrimSpace(string(content)) == strings.TrimSpace(prompt) {
+				return f.Name()
+			}
+		}
+	}
+
+	// 3. Generate new design
+	newUUID := generateUUID()
+	newDir := filepath.Join(cachedDir, newUUID)
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		fmt.Println("Error creating cache dir:", err)
+		return ""
+	}
+
+	// Save prompt
+	ioutil.WriteFile(filepath.Join(newDir, "prompt.txt"), []byte(prompt), 0644)
+
+	// Generate templates based on keywords
+	generateDesign(newDir, prompt)
+
+	return newUUID
+}
+
+// generateDesign fills dir with the templates for prompt, using -design-cmd when set
+// and falling back to the built-in keyword generator when it isn't or fails
+func generateDesign(dir, prompt string) {
+	metrics.designsGenerated.Add(1)
+	if base, rest, ok := parseExtends(prompt); ok {
+		if err := extendDesign(dir, base, rest); err != nil {
+			fmt.Println("Could not extend design", base+", generating from scratch:", err)
+			generateTemplates(dir, rest)
+		}
+		return
+	}
+	if designCmd != "" {
+		if err := runDesignCommand(dir, prompt); err != nil {
+			fmt.Println("Design command failed, using the built-in generator:", err)
+		} else {
+			return
+		}
+	}
+	generateTemplates(dir, prompt)
+}
+
+// parseExtends splits a prompt of the form "extends:<uuid> dark card" into the base
+// design's UUID and the rest of the prompt
+func parseExtends(prompt string) (base, rest string, ok bool) {
+	fields := strings.Fields(prompt)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "extends:") {
+		return "", "", false
+	}
+	base = strings.TrimPrefix(fields[0], "extends:")
+	return base, strings.Join(fields[1:], " "), isDesignUUID(base)
+}
+
+// extendDesign builds a design in dir on top of the cached design base: it copies the
+// base's templates and stylesheet, then appends the CSS for rest's keywords, so only
+// what they change overrides the base
+func extendDesign(dir, base, rest string) error {
+	baseDir := filepath.Join(designCacheDir, base)
+	files, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "prompt.txt" {
+			continue
+		}
+		if err := copyFile(filepath.Join(baseDir, f.Name()), filepath.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	vars, layout, responsive := designKeywords(rest)
+	var css strings.Builder
+	if len(vars) > 0 {
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		css.WriteString("\n/* Overrides: " + strings.ReplaceAll(rest, "*/", "") + " */\n:root {\n")
+		for _, name := range names {
+			fmt.Fprintf(&css, "    %s: %s;\n", name, vars[name])
+		}
+		css.WriteString("}\n")
+	}
+	if layout != "" {
+		fmt.Fprintf(&css, ".design-div {%s\n}\n", layout)
+	}
+	css.WriteString(responsive)
+
+	f, err := os.OpenFile(filepath.Join(dir, "style.css"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(css.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// designCmdTimeout bounds how long -design-cmd may take for one design
+const designCmdTimeout = 2 * time.Minute
+
+// runDesignCommand runs -design-cmd with the prompt on stdin and the design directory
+// as its argument. The command writes its .html templates (and optionally style.css)
+// into the directory, or writes a tar archive of them to stdout.
+func runDesignCommand(dir, prompt string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), designCmdTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, designCmd, dir)
+	cmd.Stdin = strings.NewReader(prompt)
+	cmd.Stderr = os.Stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if stdout.Len() > 0 {
+		if err := extractDesignArchive(dir, &stdout); err != nil {
+			return err
+		}
+	}
+
+	if templates, _ := filepath.Glob(filepath.Join(dir, "*.html")); len(templates) == 0 {
+		return errors.New("no templates written")
+	}
+	return nil
+}
+
+// extractDesignArchive writes the .html and .css files of a tar archive into dir.
+// Directories inside the archive are flattened, so entries can't escape dir.
+func extractDesignArchive(dir string, r io.Reader) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading design archive: %v", err)
+		}
+		name := path.Base(header.Name)
+		if header.Typeflag != tar.TypeReg || (path.Ext(name) != ".html" && path.Ext(name) != ".css") {
+			continue
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return fmt.Errorf("reading design archive: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+}
+
+// regenerateDesign regenerates a cached design from its prompt.txt,
+// updating its files in place, and drops the template sets layered from it so the next
+// request picks up the new templates
+func regenerateDesign(uuid string) (string, error) {
+	dir := filepath.Join(designCacheDir, uuid)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "prompt.txt"))
+	if err != nil {
+		return "", err
+	}
+	prompt := string(content)
+
+	// Hold the prompt's lock so a request can't generate the same design meanwhile
+	key := strings.TrimSpace(prompt)
+	lock, _ := designLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	generateDesign(dir, prompt)
+	designIndex.Store(key, uuid)
+	invalidateTemplates(dir)
+	fmt.Println("Regenerated design", uuid)
+	return prompt, nil
+}
+
+// designKeywords reads the style keywords in a prompt: the design variables they set
+// (--design-bg, --design-text, --design-accent, --design-font) and the declarations
+// and media queries the layout keywords add to the div wrapper
+func designKeywords(prompt string) (vars map[string]string, layout, responsive string) {
+	promptLower := strings.ToLower(prompt)
+	vars = make(map[string]string)
+
+	if strings.Contains(promptLower, "dark") {
+		vars["--design-bg"] = "#2c3e50"
+		vars["--design-text"] = "#ecf0f1"
+		vars["--design-accent"] = "#e74c3c"
+	}
+	if strings.Contains(promptLower, "moody") {
+		vars["--design-bg"] = "#1a1a1a"
+		vars["--design-text"] = "#dcdcdc"
+		vars["--design-accent"] = "#8e44ad"
+	}
+	if strings.Contains(promptLower, "clean") {
+		vars["--design-font"] = "'Helvetica Neue', Helvetica, Arial, sans-serif"
+	}
+	if strings.Contains(promptLower, "serif") {
+		vars["--design-font"] = "Georgia, serif"
+	}
+
+	// Layout keywords change the structure of the div wrapper
+	if strings.Contains(promptLower, "card") {
+		layout += "\n    box-shadow: 0 2px 8px rgba(0,0,0,0.15);\n    border: 1px solid rgba(0,0,0,0.08);"
+	}
+	if strings.Contains(promptLower, "grid") {
+		layout += "\n    display: grid;\n    grid-template-columns: repeat(auto-fit, minmax(200px, 1fr));\n    gap: 16px;"
+	}
+	if strings.Contains(promptLower, "two-column") || strings.Contains(promptLower, "two column") {
+		layout += "\n    display: grid;\n    grid-template-columns: 1fr 1fr;\n    gap: 24px;"
+		responsive = "\n@media (max-width: 600px) {\n  .design-div { grid-template-columns: 1fr; }\n}\n"
+	}
+	if strings.Contains(promptLower, "centered") {
+		layout += "\n    display: flex;\n    flex-direction: column;\n    align-items: center;\n    text-align: center;"
+	}
+	return vars, layout, responsive
+}
+
+func generateTemplates(dir, prompt string) {
+	// Default styles, overridden by the prompt's keywords
+	styles := map[string]string{
+		"--design-bg":     "#ffffff",
+		"--design-text":   "#333333",
+		"--design-accent": "#3498db",
+		"--design-font":   "sans-serif",
+	}
+	vars, layout, responsive := designKeywords(prompt)
+	for name, value := range vars {
+		styles[name] = value
+	}
+	bgColor, textColor, accentColor, font := styles["--design-bg"], styles["--design-text"], styles["--design-accent"], styles["--design-font"]
+
+	// Stylesheet shared by all templates of this design
+	css := fmt.Sprintf(`:root {
+    --design-bg: %s;
+    --design-text: %s;
+    --design-accent: %s;
+    --design-font: %s;
+}
+.design-h1 {
+    color: var(--design-accent);
+    font-family: var(--design-font);
+    border-bottom: 2px solid var(--design-accent);
+}
+.design-h2 {
+    color: var(--design-accent);
+    font-family: var(--design-font);
+}
+.design-p {
+    color: var(--design-text);
+    font-family: var(--design-font);
+    line-height: 1.6;
+}
+.design-div {
+    background: var(--design-bg);
+    color: var(--design-text);
+    padding: 20px;
+    border-radius: 8px;
+    margin: 10px 0;%s
+}
+.design-div a { color: var(--design-accent); }
+.design-div a:hover { text-decoration: none; }
+%s`, bgColor, textColor, accentColor, font, layout, responsive)
+	ioutil.WriteFile(filepath.Join(dir, "style.css"), []byte(css), 0644)
+
+	// H1 Template
+	ioutil.WriteFile(filepath.Join(dir, "h1.html"), []byte(`<h1 class="design-h1">`+leftDelim+"."+rightDelim+`</h1>`), 0644)
+
+	// H2 Template
+	ioutil.WriteFile(filepath.Join(dir, "h2.html"), []byte(`<h2 class="design-h2">`+leftDelim+"."+rightDelim+`</h2>`), 0644)
+
+	// P Template
+	ioutil.WriteFile(filepath.Join(dir, "p.html"), []byte(`<p class="design-p">`+leftDelim+"."+rightDelim+`</p>`), 0644)
+
+	// Div Template
+	ioutil.WriteFile(filepath.Join(dir, "div.html"), []byte(`<div class="design-div">`+leftDelim+"."+rightDelim+`</div>`), 0644)
+}
+
+func generateUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// flagInt reads an integer from flags, returning def when it's missing or not a number
+func flagInt(flags map[string]interface{}, key string, def int) int {
+	switch v := flags[key].(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n)
+		}
+	case float64:
+		return int(v)
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// readingProgressScript sizes the reading progress bar to the scrolled fraction of the page
+const readingProgressScript = `
+(function () {
+    var bar = document.getElementById('reading-progress-bar');
+    function update() {
+        var scrollable = document.documentElement.scrollHeight - window.innerHeight;
+        var progress = scrollable > 0 ? window.scrollY / scrollable : 1;
+        bar.style.width = Math.min(100, Math.max(0, progress * 100)) + '%';
+    }
+    window.addEventListener('scroll', update, { passive: true });
+    window.addEventListener('resize', update);
+    update();
+})();
+`
+
+// searchScript filters the pages from /_search client-side as the user types
+const searchScript = `
+(function () {
+    var input = document.getElementById('site-search');
+    var results = document.getElementById('site-search-results');
+    var pages = null;
+    function show(query) {
+        results.innerHTML = '';
+        pages.forEach(function (page) {
+            if ((page.title + ' ' + page.text).toLowerCase().indexOf(query) === -1) {
+                return;
+            }
+            var link = document.createElement('a');
+            link.href = page.url;
+            link.textContent = page.title;
+            var li = document.createElement('li');
+            li.appendChild(link);
+            results.appendChild(li);
+        });
+    }
+    input.addEventListener('input', function () {
+        var query = input.value.trim().toLowerCase();
+        if (!query) {
+            results.innerHTML = '';
+            return;
+        }
+        if (pages) {
+            show(query);
+            return;
+        }
+        fetch('/_search', { headers: { Accept: 'application/json' } })
+            .then(function (response) { return response.json(); })
+            .then(function (data) { pages = data; show(input.value.trim().toLowerCase()); });
+    });
+})();
+`
+
+// copyLinkScript copies the link to an item's anchor when its copy-link button is clicked
+const copyLinkScript = `
+document.addEventListener('click', function (event) {
+    var button = event.target.closest('.copy-link');
+    if (!button) {
+        return;
+    }
+    var url = location.href.split('#')[0] + '#' + button.getAttribute('data-anchor');
+    navigator.clipboard.writeText(url).then(function () {
+        button.textContent = 'Copied';
+        setTimeout(function () { button.textContent = 'Copy link'; }, 1500);
+    });
+});
+`
+
+// sortTableScript sorts a sortable table's rows by the clicked column, toggling between
+// ascending and descending and comparing by the column's data-type
+const sortTableScript = `
+document.addEventListener('click', function (event) {
+    var button = event.target.closest('.sortable-table .sort-button');
+    if (!button) {
+        return;
+    }
+    var th = button.parentNode;
+    var table = th.closest('table');
+    var column = Array.prototype.indexOf.call(th.parentNode.children, th);
+    var type = th.getAttribute('data-type');
+    var ascending = th.getAttribute('aria-sort') !== 'ascending';
+    function key(row) {
+        var cell = row.children[column];
+        var text = cell ? cell.textContent.trim() : '';
+        if (type === 'number') {
+            var n = parseFloat(text.replace(/[^0-9.eE+-]/g, ''));
+            return isNaN(n) ? -Infinity : n;
+        }
+        if (type === 'date') {
+            var d = Date.parse(text);
+            return isNaN(d) ? -Infinity : d;
+        }
+        return text.toLowerCase();
+    }
+    var body = table.tBodies[0];
+    var rows = Array.prototype.slice.call(body.rows);
+    rows.sort(function (a, b) {
+        var ka = key(a), kb = key(b);
+        var order = ka < kb ? -1 : ka > kb ? 1 : 0;
+        return ascending ? order : -order;
+    });
+    rows.forEach(function (row) { body.appendChild(row); });
+    Array.prototype.forEach.call(th.parentNode.children, function (other) {
+        other.setAttribute('aria-sort', 'none');
+    });
+    th.setAttribute('aria-sort', ascending ? 'ascending' : 'descending');
+});
+`
+
+// searchEntry is one page in the /_search index
+type searchEntry struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// serveSearchIndex lists every public content page with its searchable text as JSON.
+// Password-protected pages are left out, whoever asks, and so are items whose _when
+// doesn't hold without query parameters.
+func serveSearchIndex(w http.ResponseWriter, r *http.Request) {
+	entries := []searchEntry{}
+	for _, file := range contentFiles() {
+		data, err := readContentFile(file)
+		if err != nil {
+			continue
+		}
+		items, flags, err := loadPage(file, data)
+		if err != nil || pageCredentials(flags) != "" {
+			continue
+		}
+		items = visibleItems(items, nil)
+
+		entry := searchEntry{URL: contentURL(file), Title: headingTitle(items)}
+		var text []string
+		for _, item := range items {
+			for _, pair := range item.Content {
+				text = appendText(text, pair.Value)
+			}
+		}
+		if entry.Title == "" {
+			entry.Title = entry.URL
+		}
+		entry.Text = strings.Join(text, " ")
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// serveContentIndex lists the content pages with links, as a quick map of the site, a
+// page at a time. Files without any content items, e.g. only flags, are left out.
+func serveContentIndex(w http.ResponseWriter, r *http.Request) {
+	type indexEntry struct {
+		Link, Title, Rel string
+	}
+	var entries []indexEntry
+	for _, file := range contentFiles() {
+		data, err := readContentFile(file)
+		if err != nil {
+			continue
+		}
+		items, flags, err := loadPage(file, data)
+		if err != nil || len(items) == 0 || !authorized(r, pageCredentials(flags)) {
+			continue
+		}
+
+		link := contentURL(file)
+		title, _ := flags["title"].(string)
+		if title == "" {
+			title = headingTitle(items)
+		}
+		if title == "" {
+			title = link
+		}
+		rel, _ := filepath.Rel(contentDir, file)
+		entries = append(entries, indexEntry{Link: link, Title: title, Rel: filepath.ToSlash(rel)})
+	}
+
+	limit, offset, start, end := listPage(r, len(entries))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Content Index</title>
+</head>
+<body><h1>Content Index</h1>`)
+	if start < end {
+		fmt.Fprintf(w, "<p>Pages %d-%d of %d</p>", start+1, end, len(entries))
+	} else {
+		fmt.Fprintf(w, "<p>No pages at offset %d of %d</p>", offset, len(entries))
+	}
+	fmt.Fprint(w, "<ul>")
+	for _, entry := range entries[start:end] {
+		fmt.Fprintf(w, `<li><a href="%s">%s</a> <small>%s</small></li>`,
+			template.HTMLEscapeString(entry.Link), template.HTMLEscapeString(entry.Title), template.HTMLEscapeString(entry.Rel))
+	}
+	fmt.Fprint(w, "</ul>")
+	if offset > 0 {
+		previous := offset - limit
+		if previous < 0 {
+			previous = 0
+		}
+		fmt.Fprintf(w, `<a href="/_index?limit=%d&amp;offset=%d" rel="prev">Previous</a> `, limit, previous)
+	}
+	if end < len(entries) {
+		fmt.Fprintf(w, `<a href="/_index?limit=%d&amp;offset=%d" rel="next">Next</a>`, limit, end)
+	}
+	fmt.Fprint(w, "</body></html>")
+}
+
+// sitemapURL is one <url> entry of sitemap.xml
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// sitemapURLSet is the root element of sitemap.xml
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// serveSitemap lists every public content page in sitemap.xml format, with the file's
+// modification time as lastmod. Sitemap URLs must be absolute, so it's only served
+// with -base-url; the request's Host header isn't trusted for them. Password-protected
+// pages, and pages that don't parse, are left out.
+func serveSitemap(w http.ResponseWriter, r *http.Request) {
+	base := strings.TrimSuffix(baseURL, "/")
+	if base == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	set := sitemapURLSet{URLs: []sitemapURL{}}
+	for _, file := range contentFiles() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		data, err := readContentFile(file)
+		if err != nil {
+			continue
+		}
+		if _, flags, err := loadPage(file, data); err != nil || pageCredentials(flags) != "" {
+			continue
+		}
+		set.URLs = append(set.URLs, sitemapURL{
+			Loc:     base + contentURL(file),
+			LastMod: info.ModTime().UTC().Format("2006-01-02"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	fmt.Fprint(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	encoder.Encode(set)
+}
+
+// headingTitle returns the text of the first heading in items, or "" if there is none
+func headingTitle(items []ContentItem) string {
+	for _, item := range items {
 		for _, pair := range item.Content {
-			tag := pair.Key
-			content := pair.Value
+			if isHeadingTag(pair.Key) {
+				if title := strings.TrimSpace(formatScalar(pair.Value)); title != "" {
+					return title
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// pageTitle returns the page's <title>: flags.title, else the first heading's text,
+// else "JSON Server"
+func pageTitle(items []ContentItem, flags map[string]interface{}) string {
+	if title, ok := flags["title"].(string); ok && strings.TrimSpace(title) != "" {
+		return title
+	}
+	if title := headingTitle(items); title != "" {
+		return title
+	}
+	return "JSON Server"
+}
+
+// isHeadingTag reports whether tag is h1 through h6
+func isHeadingTag(tag string) bool {
+	return len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6'
+}
+
+// appendText appends the scalar values found in value (recursively) to text
+func appendText(text []string, value interface{}) []string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			text = appendText(text, child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			text = appendText(text, child)
+		}
+	case []OrderedPair:
+		for _, pair := range v {
+			text = appendText(text, pair.Value)
+		}
+	case nil:
+	default:
+		text = append(text, formatScalar(v))
+	}
+	return text
+}
+
+// cdnSources are the hosts serving the csslib stylesheets and scripts
+const cdnSources = "https://cdn.jsdelivr.net https://cdn.tailwindcss.com https://cdnjs.cloudflare.com"
+
+// contentSecurityPolicy returns the policy sent under -csp. Inline scripts and styles
+// are only allowed with the response's nonce; csslib CDNs stay allowed.
+func contentSecurityPolicy(nonce string) string {
+	return fmt.Sprintf("default-src 'self'; script-src 'self' 'nonce-%s' %s; style-src 'self' 'nonce-%s' %s; img-src 'self' data: https:",
+		nonce, cdnSources, nonce, cdnSources)
+}
+
+// pagePolicy returns the Content-Security-Policy for a page using nonce, or "" for none.
+// flags.csp overrides -csp: true sends the default policy, false none, and a string is
+// sent as the policy with {nonce} replaced by the nonce.
+func pagePolicy(flags map[string]interface{}, nonce string) string {
+	switch v := flags["csp"].(type) {
+	case bool:
+		if !v {
+			return ""
+		}
+	case string:
+		return strings.ReplaceAll(v, "{nonce}", nonce)
+	default:
+		if !cspEnabled {
+			return ""
+		}
+	}
+	return contentSecurityPolicy(nonce)
+}
+
+// newNonce returns a random value for CSP nonces
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// formatScalar formats a JSON value as text: null as an empty string, booleans as
+// true/false, and numbers in plain decimal notation without exponents
+func formatScalar(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		if !strings.ContainsAny(string(v), "eE") {
+			return string(v)
+		}
+		f, _, err := big.ParseFloat(string(v), 10, 256, big.ToNearestEven)
+		if err != nil {
+			return string(v)
+		}
+		if f.IsInt() {
+			return f.Text('f', 0)
+		}
+		if fl, err := strconv.ParseFloat(string(v), 64); err == nil {
+			return strconv.FormatFloat(fl, 'f', -1, 64)
+		}
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case templateData:
+		return formatScalar(v.Value)
+	default:
+		// Objects and arrays show as JSON rather than Go's map[...] formatting
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(v); err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return strings.TrimSuffix(data.String(), "\n")
+	}
+}
+
+// valueType names a decoded JSON value's type for warnings
+func valueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	default:
+		return "a number"
+	}
+}
+
+// renderMismatch logs a value whose type the tag can't render and writes the value's
+// escaped text in a paragraph instead
+func renderMismatch(w io.Writer, tag, want string, value interface{}) {
+	fmt.Printf("Warning: %s expects %s but got %s; rendering it as text\n", tag, want, valueType(value))
+	fmt.Fprintf(w, `<p class="type-mismatch">%s</p>`, template.HTMLEscapeString(formatScalar(value)))
+}
+
+// renderAccordion renders an array of {"title","content"} sections as details/summary
+// elements. An object {"mode": "single", "sections": [...]} lets only one section be
+// open at a time; the default "multi" mode lets sections open independently.
+func renderAccordion(w io.Writer, name string, content interface{}) {
+	mode := "multi"
+	sections, ok := content.([]interface{})
+	if obj, isObj := content.(map[string]interface{}); isObj {
+		if m, ok := obj["mode"].(string); ok {
+			mode = strings.ToLower(m)
+		}
+		sections, ok = obj["sections"].([]interface{})
+	}
+	if !ok {
+		renderMismatch(w, "accordion", "an array of sections", content)
+		return
+	}
+
+	fmt.Fprint(w, `<div class="accordion">`)
+	for _, s := range sections {
+		section, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		fmt.Fprint(w, "<details")
+		if mode == "single" {
+			fmt.Fprintf(w, ` name="%s"`, template.HTMLEscapeString(name))
+		}
+		if open, ok := section["open"].(bool); ok && open {
+			fmt.Fprint(w, " open")
+		}
+		fmt.Fprintf(w, "><summary>%s</summary><div>%s</div></details>",
+			template.HTMLEscapeString(formatScalar(section["title"])),
+			template.HTMLEscapeString(formatScalar(section["content"])))
+	}
+	fmt.Fprint(w, "</div>")
+}
+
+// maxListDepth bounds how deeply ul and ol items may nest
+const maxListDepth = 16
+
+// templateData is what a tag's template executes with. {{.}} still prints the value,
+// and {{.Value}} reaches into an object or array value.
+type templateData struct {
+	Value interface{}
+	// ID is the enclosing item's ID and Index its position on the page, from 0
+	ID    string
+	Index int
+	Flags map[string]interface{}
+	// Siblings maps each tag of the item to its value, including this one
+	Siblings map[string]interface{}
+}
+
+// String makes {{.}} and helpers such as {{upper .}} see the value
+func (d templateData) String() string {
+	return formatScalar(d.Value)
+}
+
+// itemValues maps an item's tags to their values
+func itemValues(item ContentItem) map[string]interface{} {
+	values := make(map[string]interface{}, len(item.Content))
+	for _, pair := range item.Content {
+		values[pair.Key] = pair.Value
+	}
+	return values
+}
+
+// renderItems writes the content items, each in its wrapper, without the document shell
+func renderItems(w io.Writer, items []ContentItem, flags map[string]interface{}, ctx renderContext) error {
+	templates := ctx.Templates
+
+	copyLinks, _ := flags["copylinks"].(bool)
+	var anchors []string
+	if copyLinks {
+		anchors = itemAnchors(items)
+	}
+	cites := collectCitations(items, flags)
+	bibliographyRendered := false
+	classes := listClasses(flags)
+
+	// flags.flatitems renders the items' elements as direct siblings, without wrappers or ids
+	flat, _ := flags["flatitems"].(bool)
+
+	var item ContentItem
+	var itemIndex int
+	var renderTag func(tag string, content interface{}) error
+	var renderList func(tag string, list []interface{}) error
+	renderTag = func(tag string, content interface{}) error {
+		// Check if a template exists for this tag
+		if tmpl := tagTemplate(templates, tag); tmpl != nil {
+			data := templateData{Value: content, ID: item.ID, Index: itemIndex, Flags: flags, Siblings: itemValues(item)}
+			if err := tmpl.Execute(w, data); err != nil {
+				// Under -strict the page fails instead of losing the section
+				if strictMode {
+					return fmt.Errorf("template %s in item %s: %v", tag, item.ID, err)
+				}
+				fmt.Fprintf(w, "<!-- Error rendering template %s: %v -->", tag, err)
+			}
+			return nil
+		}
+
+		// If it's a non-standard tag without a template, skip rendering (already in JS)
+		if !isStandardTag(tag, flags) && !builtinTags[tag] {
+			return nil
+		}
+
+		switch tag {
+		case "accordion":
+			renderAccordion(w, "accordion-"+item.ID, content)
+		case "cite":
+			cites.renderCite(w, content)
+		case "bibliography":
+			cites.renderBibliography(w)
+			bibliographyRendered = true
+		case "code", "pre":
+			renderCode(w, content)
+		case "dl":
+			renderDefinitionList(w, content, flags)
+		case "svg":
+			renderSVG(w, content, flags)
+		case "img":
+			renderImage(w, content, flags)
+		case "table":
+			renderTable(w, content, flags)
+		case "input":
+			renderInput(w, content)
+		case "progress":
+			renderProgress(w, content)
+		case "ul", "ol":
+			if list, ok := content.([]interface{}); ok {
+				return renderList(tag, list)
+			}
+			fmt.Fprintf(w, "<%s%s>", tag, classAttr(classes[tag]))
+			if _, ok := content.(map[string]interface{}); ok {
+				fmt.Printf("Warning: %s expects an array but got an object; rendering it as text\n", tag)
+				fmt.Fprintf(w, "<li%s>%s</li>", classAttr(classes["li"]), template.HTMLEscapeString(formatScalar(content)))
+			} else {
+				// Fallback if it's not a list
+				fmt.Fprintf(w, "<li%s>%s</li>", classAttr(classes["li"]), textHTML(formatScalar(content), flags))
+			}
+			fmt.Fprintf(w, "</%s>", tag)
+		default:
+			nested, ok := content.([]OrderedPair)
+			if !ok {
+				renderElement(w, tag, content, flags)
+				return nil
+			}
+			// A landmark with nested content renders its tags inside it, in order
+			attrs := map[string]interface{}{}
+			fmt.Fprintf(w, "<%s", tag)
+			for _, pair := range nested {
+				if isAttrKey(pair.Key) {
+					attrs[pair.Key] = pair.Value
+				}
+			}
+			writeAttrs(w, attrs, "id", "class")
+			fmt.Fprint(w, ">")
+			for _, pair := range nested {
+				if isAttrKey(pair.Key) {
+					continue
+				}
+				if err := renderTag(pair.Key, pair.Value); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(w, "</%s>", tag)
+		}
+		return nil
+	}
+
+	// renderList renders a ul or ol. An item that's an array becomes a nested list of
+	// the same kind, and an object item renders its tags inside the li, with its
+	// "text" as the li's text and class, id, data-* and aria-* as its attributes.
+	listDepth := 0
+	renderList = func(tag string, list []interface{}) error {
+		listDepth++
+		defer func() { listDepth-- }()
+		if listDepth > maxListDepth {
+			fmt.Printf("Warning: lists nested deeper than %d in item %s; rendering the rest as text\n", maxListDepth, item.ID)
+			fmt.Fprint(w, template.HTMLEscapeString(formatScalar(list)))
+			return nil
+		}
+
+		fmt.Fprintf(w, "<%s%s>", tag, classAttr(classes[tag]))
+		for _, li := range list {
+			switch v := li.(type) {
+			case []interface{}:
+				fmt.Fprintf(w, "<li%s>", classAttr(classes["li"]))
+				if err := renderList(tag, v); err != nil {
+					return err
+				}
+				fmt.Fprint(w, "</li>")
+			case []OrderedPair:
+				attrs := map[string]interface{}{}
+				if classes["li"] != "" {
+					attrs["class"] = classes["li"]
+				}
+				for _, pair := range v {
+					if isAttrKey(pair.Key) {
+						attrs[pair.Key] = pair.Value
+					}
+				}
+				fmt.Fprint(w, "<li")
+				writeAttrs(w, attrs, "id", "class")
+				fmt.Fprint(w, ">")
+				for _, pair := range v {
+					switch {
+					case isAttrKey(pair.Key):
+					case pair.Key == "text":
+						fmt.Fprint(w, textHTML(formatScalar(pair.Value), flags))
+					default:
+						if err := renderTag(pair.Key, pair.Value); err != nil {
+							return err
+						}
+					}
+				}
+				fmt.Fprint(w, "</li>")
+			default:
+				fmt.Fprintf(w, "<li%s>%s</li>", classAttr(classes["li"]), textHTML(formatScalar(li), flags))
+			}
+		}
+		fmt.Fprintf(w, "</%s>", tag)
+		return nil
+	}
+
+	// A streamed page's items after the first come from ctx.More as they're read
+	for i := 0; ; i++ {
+		if i < len(items) {
+			item = items[i]
+		} else if ctx.More == nil {
+			break
+		} else {
+			next, ok, err := ctx.More()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			item = next
+		}
+		itemIndex = i
+		// Wrap each numbered object in a div, or the element named by its _tag
+		wrapper := item.Tag
+		if wrapper == "" {
+			wrapper = "div"
+		}
+		switch {
+		case flat:
+		case copyLinks:
+			fmt.Fprintf(w, `<%s id="%s" class="item-anchored"><a class="item-anchor" href="#%s" aria-hidden="true">#</a><button type="button" class="copy-link" data-anchor="%s" aria-label="Copy link to this section">Copy link</button>`, wrapper, anchors[i], anchors[i], anchors[i])
+		default:
+			fmt.Fprintf(w, "<%s id='%s'>", wrapper, template.HTMLEscapeString(item.ID))
+		}
+
+		for _, pair := range item.Content {
+			if err := renderTag(pair.Key, pair.Value); err != nil {
+				return err
+			}
+		}
+
+		// Close the wrapper
+		if !flat {
+			fmt.Fprintf(w, "</%s>", wrapper)
+		}
+	}
+
+	// Cited works are listed after the content unless the page placed the list itself
+	if len(cites.Order) > 0 && !bibliographyRendered {
+		cites.renderBibliography(w)
+	}
+	return nil
+}
+
+// citations numbers the keys of a page's "cite" tags in order of first use and resolves
+// them against the bibliography file named by flags.bibliography
+type citations struct {
+	Style   string
+	Entries map[string]interface{}
+	Order   []string
+	Numbers map[string]int
+}
+
+// collectCitations scans items for cited keys and loads the page's bibliography.
+// flags.citationstyle picks "numeric" ([1], the default) or "author-year" ((Doe, 2020)).
+func collectCitations(items []ContentItem, flags map[string]interface{}) *citations {
+	c := &citations{Style: "numeric", Numbers: make(map[string]int)}
+	if style, ok := flags["citationstyle"].(string); ok && style == "author-year" {
+		c.Style = style
+	}
+	for _, item := range items {
+		for _, pair := range item.Content {
+			if pair.Key != "cite" {
+				continue
+			}
+			for _, key := range citeKeys(pair.Value) {
+				if _, ok := c.Numbers[key]; !ok {
+					c.Order = append(c.Order, key)
+					c.Numbers[key] = len(c.Order)
+				}
+			}
+		}
+	}
+	if len(c.Order) == 0 {
+		return c
+	}
+
+	file, _ := flags["bibliography"].(string)
+	if file == "" {
+		fmt.Println("Citations without a bibliography: set flags.bibliography")
+		return c
+	}
+	fullPath, err := resolveContentPath(file)
+	if err == nil {
+		var data []byte
+		if data, err = readContentFile(fullPath); err == nil {
+			var entries map[string]interface{}
+			if err = decodeJSON(data, &entries); err == nil {
+				c.Entries = entries
+			}
+		}
+	}
+	if err != nil {
+		fmt.Println("Could not load bibliography", file+":", err)
+	}
+	for _, key := range c.Order {
+		if _, ok := c.Entries[key]; !ok {
+			fmt.Printf("Citation %q not found in bibliography %s\n", key, file)
+		}
+	}
+	return c
+}
+
+// citeKeys returns the bibliography keys of a "cite" value: one key or an array of them
+func citeKeys(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var keys []string
+		for _, key := range v {
+			if s, ok := key.(string); ok {
+				keys = append(keys, s)
+			}
+		}
+		return keys
+	}
+	return nil
+}
+
+// renderCite renders an inline citation linking to each key's bibliography entry.
+// Keys missing from the bibliography are flagged with a cite-missing class.
+func (c *citations) renderCite(w io.Writer, content interface{}) {
+	if len(citeKeys(content)) == 0 {
+		renderMismatch(w, "cite", "a key or an array of keys", content)
+		return
+	}
+	var refs []string
+	for _, key := range citeKeys(content) {
+		entry, ok := c.Entries[key].(map[string]interface{})
+		if !ok {
+			refs = append(refs, fmt.Sprintf(`<span class="cite-missing" title="Missing from bibliography">?%s</span>`, template.HTMLEscapeString(key)))
+			continue
+		}
+		label := strconv.Itoa(c.Numbers[key])
+		if c.Style == "author-year" {
+			label = formatScalar(entry["author"])
+			if year := formatScalar(entry["year"]); year != "" {
+				label += ", " + year
+			}
+		}
+		refs = append(refs, fmt.Sprintf(`<a href="#%s">%s</a>`, citationAnchor(key), template.HTMLEscapeString(label)))
+	}
+
+	if c.Style == "author-year" {
+		fmt.Fprintf(w, `<span class="cite">(%s)</span>`, strings.Join(refs, "; "))
+	} else {
+		fmt.Fprintf(w, `<span class="cite">[%s]</span>`, strings.Join(refs, ", "))
+	}
+}
+
+// renderBibliography lists the cited entries in order of first citation
+func (c *citations) renderBibliography(w io.Writer) {
+	fmt.Fprint(w, `<section class="bibliography"><h2>References</h2><ol>`)
+	for _, key := range c.Order {
+		entry, ok := c.Entries[key].(map[string]interface{})
+		if !ok {
+			fmt.Fprintf(w, `<li id="%s" class="cite-missing">Missing reference: %s</li>`, citationAnchor(key), template.HTMLEscapeString(key))
+			continue
+		}
+		fmt.Fprintf(w, `<li id="%s">%s</li>`, citationAnchor(key), formatReference(entry))
+	}
+	fmt.Fprint(w, "</ol></section>")
+}
+
+// formatReference renders a bibliography entry as "Author (Year). Title. Source. URL"
+func formatReference(entry map[string]interface{}) string {
+	var parts []string
+	author := template.HTMLEscapeString(formatScalar(entry["author"]))
+	if year := formatScalar(entry["year"]); year != "" {
+		author += " (" + template.HTMLEscapeString(year) + ")"
+	}
+	if author != "" {
+		parts = append(parts, author)
+	}
+	if title := formatScalar(entry["title"]); title != "" {
+		parts = append(parts, "<cite>"+template.HTMLEscapeString(title)+"</cite>")
+	}
+	for _, key := range []string{"journal", "publisher"} {
+		if source := formatScalar(entry[key]); source != "" {
+			parts = append(parts, template.HTMLEscapeString(source))
+		}
+	}
+	reference := strings.Join(parts, ". ")
+	if link := formatScalar(entry["url"]); strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://") {
+		link = template.HTMLEscapeString(link)
+		reference += fmt.Sprintf(`. <a href="%s">%s</a>`, link, link)
+	}
+	return reference
+}
+
+// citationAnchor is the id of a key's bibliography entry
+func citationAnchor(key string) string {
+	return "ref-" + strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(key), "-"), "-")
+}
+
+// fragmentData is passed to the -wrapper template: {{.Content}} is the rendered items
+type fragmentData struct {
+	Content template.HTML
+	Flags   map[string]interface{}
+}
+
+// renderContext is the request-scoped state renderPage needs besides the content
+type renderContext struct {
+	DesignUUID string
+	Templates  *template.Template
+	// Nonce is set on inline <style> and <script> blocks when a CSP is sent
+	Nonce string
+	// Timing, under -server-timing, gets the render time for the Server-Timing header
+	Timing *serverTiming
+	// More, for a streamed .jsonl page, returns the items after those passed to
+	// renderPage as their lines are read; ok is false after the last one
+	More func() (item ContentItem, ok bool, err error)
+}
+
+// pageContext resolves a page's design (generating it from flags.designprompt in AI
+// design mode) and loads its templates, layered with components/<flags.templates>
+func pageContext(flags map[string]interface{}) renderContext {
+	var designUUID string
+	if prompt, ok := flags["designprompt"]; ok && aiDesign.Load() {
+		designUUID = getOrGenerateDesign(fmt.Sprintf("%v", prompt))
+	}
+	pageTemplates, _ := flags["templates"].(string)
+	return renderContext{
+		DesignUUID: designUUID,
+		Templates:  loadTemplates(templateDirs(designUUID, pageTemplates)),
+	}
+}
+
+// Render writes the HTML page for items to w, the way the server renders it but
+// without a request: no Content-Security-Policy nonces or _when filtering. It returns
+// the template or include error that -strict would turn into a 500.
+func Render(items []ContentItem, flags map[string]interface{}, w io.Writer) error {
+	return renderPage(w, items, flags, pageContext(flags))
+}
+
+// cssLibResources are the stylesheets and scripts each csslib loads, in order
+var cssLibResources = map[string][]string{
+	"bootstrap": {
+		"https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/css/bootstrap.min.css",
+		"https://cdn.jsdelivr.net/npm/bootstrap@5.3.2/dist/js/bootstrap.bundle.min.js",
+	},
+	"tailwind": {"https://cdn.tailwindcss.com"},
+	"bulma":    {"https://cdn.jsdelivr.net/npm/bulma@0.9.4/css/bulma.min.css"},
+	"materialize": {
+		"https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/css/materialize.min.css",
+		"https://cdnjs.cloudflare.com/ajax/libs/materialize/1.0.0/js/materialize.min.js",
+	},
+}
+
+// cssLibs returns the lowercased library names in flags.csslib, which is one name
+// or an array of them
+func cssLibs(flags map[string]interface{}) []string {
+	var libs []string
+	switch v := flags["csslib"].(type) {
+	case string:
+		libs = append(libs, strings.ToLower(v))
+	case []interface{}:
+		for _, lib := range v {
+			if name, ok := lib.(string); ok {
+				libs = append(libs, strings.ToLower(name))
+			}
+		}
+	}
+	return libs
+}
+
+// libraryListClasses are the list classes each csslib styles lists with
+var libraryListClasses = map[string]map[string]string{
+	"bootstrap":   {"ul": "list-group", "ol": "list-group list-group-numbered", "li": "list-group-item"},
+	"materialize": {"ul": "collection", "ol": "collection", "li": "collection-item"},
+	"tailwind":    {"ul": "list-disc pl-5", "ol": "list-decimal pl-5"},
+}
+
+// listClasses returns the classes for ul, ol and li: the active csslib's defaults,
+// overridden per element by flags.listclasses, e.g. {"ul": "my-list", "li": ""}
+func listClasses(flags map[string]interface{}) map[string]string {
+	classes := make(map[string]string)
+	for _, cssLib := range cssLibs(flags) {
+		if libClasses, ok := libraryListClasses[cssLib]; ok {
+			for tag, class := range libClasses {
+				classes[tag] = class
+			}
+			break
+		}
+	}
+	if overrides, ok := flags["listclasses"].(map[string]interface{}); ok {
+		for _, tag := range []string{"ul", "ol", "li"} {
+			if class, ok := overrides[tag].(string); ok {
+				classes[tag] = class
+			}
+		}
+	}
+	return classes
+}
+
+// classAttr returns a class attribute for class, or nothing when it's empty
+func classAttr(class string) string {
+	if class == "" {
+		return ""
+	}
+	return ` class="` + template.HTMLEscapeString(class) + `"`
+}
+
+// itemAnchors slugifies the item IDs for use as anchors, suffixing repeats so each stays unique
+func itemAnchors(items []ContentItem) []string {
+	anchors := make([]string, len(items))
+	seen := make(map[string]bool)
+	for i, item := range items {
+		slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(item.ID), "-"), "-")
+		if slug == "" {
+			slug = "item"
+		}
+		anchor := slug
+		for n := 2; seen[anchor]; n++ {
+			anchor = fmt.Sprintf("%s-%d", slug, n)
+		}
+		seen[anchor] = true
+		anchors[i] = anchor
+	}
+	return anchors
+}
+
+var slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// renderElement renders a standard tag. The value is the element's text, or an object
+// {"text": ..., "class": ..., "id": ...} where data-* and aria-* keys become
+// attributes as well.
+func renderElement(w io.Writer, tag string, content interface{}, flags map[string]interface{}) {
+	text := content
+	attrs := map[string]interface{}{}
+	if obj, ok := content.(map[string]interface{}); ok {
+		text = obj["text"]
+		for name, value := range obj {
+			if isAttrKey(name) {
+				attrs[name] = value
+			}
+		}
+	}
 
-			// Check if a template exists for this tag
-			if templates != nil {
-				if tmpl := templates.Lookup(tag + ".html"); tmpl != nil {
-					if err := tmpl.Execute(w, content); err != nil {
-						fmt.Fprintf(w, "<!-- Error rendering template %s: %v -->", tag, err)
-					}
-					continue
-				}
-				if tmpl := templates.Lookup(tag); tmpl != nil {
-					if err := tmpl.Execute(w, content); err != nil {
-						fmt.Fprintf(w, "<!-- Error rendering template %s: %v -->", tag, err)
-					}
-					continue
+	fmt.Fprintf(w, "<%s", tag)
+	writeAttrs(w, attrs, "id", "class")
+	switch text.(type) {
+	case []interface{}:
+		fmt.Fprintf(w, ">%s</%s>", inlineHTML(tag, text, flags), tag)
+	case map[string]interface{}:
+		// Nested structures have no text form; show them escaped rather than as markup
+		fmt.Printf("Warning: %s expects text but got %s; rendering it as text\n", tag, valueType(text))
+		fmt.Fprintf(w, ">%s</%s>", template.HTMLEscapeString(formatScalar(text)), tag)
+	default:
+		fmt.Fprintf(w, ">%s</%s>", textHTML(formatScalar(text), flags), tag)
+	}
+}
+
+// isAttrKey reports whether an object key is passed through as an HTML attribute:
+// class, id, data-* or aria-*
+func isAttrKey(name string) bool {
+	return name == "class" || name == "id" || strings.HasPrefix(name, "data-") || strings.HasPrefix(name, "aria-")
+}
+
+// inlineTags may appear inside text as {"tag": "strong", "text": ...}
+var inlineTags = map[string]bool{
+	"a": true, "abbr": true, "b": true, "br": true, "code": true, "em": true, "i": true,
+	"mark": true, "s": true, "small": true, "span": true, "strong": true, "sub": true,
+	"sup": true, "u": true,
+}
+
+// inlineHTML renders rich text: a string, or an array of strings and inline elements
+// such as {"tag": "a", "text": "docs", "href": "/docs"}, in order. An element's text may
+// itself be such an array. Besides class, id, data-* and aria-*, links keep href, title,
+// target and rel, and abbr keeps title. parent names the enclosing tag for warnings.
+func inlineHTML(parent string, value interface{}, flags map[string]interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		var out strings.Builder
+		for _, part := range v {
+			out.WriteString(inlineHTML(parent, part, flags))
+		}
+		return out.String()
+	case map[string]interface{}:
+		tag, _ := v["tag"].(string)
+		if !inlineTags[tag] {
+			fmt.Printf("Warning: %s contains unsupported inline tag %q; rendering its text only\n", parent, tag)
+			return inlineHTML(parent, v["text"], flags)
+		}
+		attrs := map[string]interface{}{}
+		for name, attr := range v {
+			switch {
+			case name == "class" || name == "id" || strings.HasPrefix(name, "data-") || strings.HasPrefix(name, "aria-"):
+				attrs[name] = attr
+			case tag == "a" && (name == "title" || name == "target" || name == "rel"):
+				attrs[name] = attr
+			case tag == "a" && name == "href" && safeHref(formatScalar(attr)):
+				attrs[name] = attr
+			case tag == "abbr" && name == "title":
+				attrs[name] = attr
+			}
+		}
+		var out bytes.Buffer
+		fmt.Fprintf(&out, "<%s", tag)
+		writeAttrs(&out, attrs, "href", "id", "class")
+		if tag == "br" {
+			out.WriteString(">")
+			return out.String()
+		}
+		fmt.Fprintf(&out, ">%s</%s>", inlineHTML(tag, v["text"], flags), tag)
+		return out.String()
+	default:
+		return textHTML(formatScalar(v), flags)
+	}
+}
+
+// safeHref reports whether a link target is relative or uses a harmless scheme,
+// keeping javascript: and data: URLs out of inline links
+func safeHref(href string) bool {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto", "tel":
+		return true
+	}
+	return false
+}
+
+// textHTML escapes text for use as element content, unless the page sets
+// flags.rawhtml to embed its values as HTML
+func textHTML(text string, flags map[string]interface{}) string {
+	if raw, ok := flags["rawhtml"].(bool); ok && raw {
+		return text
+	}
+	return template.HTMLEscapeString(text)
+}
+
+// renderImage renders an img element. The value is the src, or an object of attributes
+// such as {"src": ..., "class": ...}. flags.imgattrs supplies page-wide defaults (e.g.
+// loading, decoding, class), which attributes given on the img itself override.
+func renderImage(w io.Writer, content interface{}, flags map[string]interface{}) {
+	src := content
+	if obj, ok := content.(map[string]interface{}); ok {
+		src = obj["src"]
+	}
+	if _, ok := src.(string); !ok {
+		renderMismatch(w, "img", `a src string or {"src": ...}`, content)
+		return
+	}
+
+	attrs := map[string]interface{}{"alt": "Image"}
+	if defaults, ok := flags["imgattrs"].(map[string]interface{}); ok {
+		copyAllowedAttrs(attrs, defaults, imgAttrNames, "img")
+	}
+	if obj, ok := content.(map[string]interface{}); ok {
+		copyAllowedAttrs(attrs, obj, imgAttrNames, "img")
+	} else {
+		attrs["src"] = content
+	}
+
+	fmt.Fprint(w, "<img")
+	writeAttrs(w, attrs, "src", "alt", "width", "height")
+	fmt.Fprint(w, ">")
+}
+
+// imgAttrNames are the attributes an img object and flags.imgattrs may set, besides
+// class, id, data-* and aria-*. Event handlers such as onerror never pass.
+var imgAttrNames = map[string]bool{
+	"src": true, "alt": true, "width": true, "height": true, "loading": true, "decoding": true,
+	"sizes": true, "referrerpolicy": true, "fetchpriority": true,
+}
+
+// inputAttrNames are the attributes an input object may set, besides class, id, data-*
+// and aria-*
+var inputAttrNames = map[string]bool{
+	"type": true, "name": true, "value": true, "checked": true, "placeholder": true,
+	"min": true, "max": true, "step": true,
+}
+
+// copyAllowedAttrs copies the attributes in src that are in names, or are class, id,
+// data-* or aria-*, to dst. Others, such as on* event handlers, are logged and dropped.
+func copyAllowedAttrs(dst, src map[string]interface{}, names map[string]bool, tag string) {
+	for name, value := range src {
+		if !names[name] && !isAttrKey(name) {
+			fmt.Printf("Ignoring %s attribute %q\n", tag, name)
+			continue
+		}
+		dst[name] = value
+	}
+}
+
+// attrNamePattern matches attribute names that are safe to emit unquoted
+var attrNamePattern = regexp.MustCompile(`^[a-zA-Z_:][-a-zA-Z0-9_:.]*$`)
+
+// writeAttrs writes attrs as escaped HTML attributes: the names in first in that order,
+// then the rest sorted. true emits a bare attribute, false and null omit it, and invalid
+// names are skipped.
+func writeAttrs(w io.Writer, attrs map[string]interface{}, first ...string) {
+	var names []string
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ordered := append([]string{}, first...)
+	for _, name := range names {
+		isFirst := false
+		for _, f := range first {
+			isFirst = isFirst || f == name
+		}
+		if !isFirst {
+			ordered = append(ordered, name)
+		}
+	}
+
+	for _, name := range ordered {
+		value, ok := attrs[name]
+		if !ok || !attrNamePattern.MatchString(name) {
+			continue
+		}
+		switch v := value.(type) {
+		case nil:
+		case bool:
+			if v {
+				fmt.Fprintf(w, " %s", name)
+			}
+		default:
+			fmt.Fprintf(w, ` %s="%s"`, name, template.HTMLEscapeString(formatScalar(v)))
+		}
+	}
+}
+
+// renderInput renders a boolean as a checkbox, checked when true, and other scalars as a
+// text input holding the value. An object is taken as the input's attributes, limited to
+// inputAttrNames and class, id, data-* and aria-*.
+func renderInput(w io.Writer, content interface{}) {
+	attrs := map[string]interface{}{}
+	switch v := content.(type) {
+	case bool:
+		attrs["type"] = "checkbox"
+		attrs["checked"] = v
+	case map[string]interface{}:
+		copyAllowedAttrs(attrs, v, inputAttrNames, "input")
+	case []interface{}:
+		renderMismatch(w, "input", "a boolean, text or an object of attributes", content)
+		return
+	default:
+		attrs["type"] = "text"
+		attrs["value"] = formatScalar(v)
+	}
+	fmt.Fprint(w, "<input")
+	writeAttrs(w, attrs, "type", "name", "value", "checked")
+	fmt.Fprint(w, ">")
+}
+
+// renderDefinitionList renders a <dl> from an object of terms and definitions, in the
+// order they're written, or from an array of {"term": ..., "def": ...} objects
+func renderDefinitionList(w io.Writer, content interface{}, flags map[string]interface{}) {
+	var terms []OrderedPair
+	switch v := content.(type) {
+	case []OrderedPair:
+		terms = v
+	case []interface{}:
+		for _, entry := range v {
+			obj, ok := entry.(map[string]interface{})
+			if !ok {
+				renderMismatch(w, "dl", `an object or an array of {"term": ..., "def": ...}`, content)
+				return
+			}
+			terms = append(terms, OrderedPair{Key: formatScalar(obj["term"]), Value: obj["def"]})
+		}
+	default:
+		renderMismatch(w, "dl", `an object or an array of {"term": ..., "def": ...}`, content)
+		return
+	}
+	fmt.Fprint(w, "<dl>")
+	for _, term := range terms {
+		fmt.Fprintf(w, "<dt>%s</dt><dd>%s</dd>", template.HTMLEscapeString(term.Key), textHTML(formatScalar(term.Value), flags))
+	}
+	fmt.Fprint(w, "</dl>")
+}
+
+// svgCache holds the SVG files read by renderSVG, by path; they're read once per run
+var svgCache sync.Map
+
+// renderSVG inlines an SVG so CSS can style it. The value is a file under assets/,
+// such as "/assets/icons/star.svg", or with flags.rawhtml an <svg> element itself.
+func renderSVG(w io.Writer, content interface{}, flags map[string]interface{}) {
+	ref, ok := content.(string)
+	if !ok {
+		renderMismatch(w, "svg", "a path under assets/", content)
+		return
+	}
+	if strings.HasPrefix(strings.TrimSpace(ref), "<") {
+		if raw, _ := flags["rawhtml"].(bool); !raw {
+			renderMismatch(w, "svg", "a path under assets/ (inline markup needs flags.rawhtml)", content)
+			return
+		}
+		fmt.Fprint(w, ref)
+		return
+	}
+	svg, err := loadSVG(ref)
+	if err != nil {
+		fmt.Printf("Warning: could not inline svg %q: %v\n", ref, err)
+		return
+	}
+	fmt.Fprint(w, svg)
+}
+
+// loadSVG returns the <svg> element of the file ref names under assets/, from
+// svgCache when it has been read before
+func loadSVG(ref string) (string, error) {
+	rel := strings.TrimPrefix(strings.TrimPrefix(ref, "/"), "assets/")
+	cleaned := path.Clean(rel)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.New("path is outside assets")
+	}
+	if path.Ext(cleaned) != ".svg" {
+		return "", errors.New("not an .svg file")
+	}
+	if svg, ok := svgCache.Load(cleaned); ok {
+		return svg.(string), nil
+	}
+
+	fullPath := filepath.Join("assets", filepath.FromSlash(cleaned))
+	if err := checkContainedIn("assets", fullPath); err != nil {
+		return "", err
+	}
+	data, err := readContentFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	// Drop any XML prolog or doctype before the element
+	start := bytes.Index(data, []byte("<svg"))
+	if start == -1 {
+		return "", errors.New("no <svg> element")
+	}
+	svg := string(data[start:])
+	svgCache.Store(cleaned, svg)
+	return svg, nil
+}
+
+// renderProgress renders a <progress> bar from a number out of 100, or from
+// {"value": 3, "max": 10}
+func renderProgress(w io.Writer, content interface{}) {
+	value, limit := content, interface{}(json.Number("100"))
+	if obj, ok := content.(map[string]interface{}); ok {
+		value = obj["value"]
+		if m, ok := obj["max"]; ok {
+			limit = m
+		}
+	}
+	v, vok := value.(json.Number)
+	m, mok := limit.(json.Number)
+	if !vok || !mok {
+		renderMismatch(w, "progress", `a number or {"value": ..., "max": ...}`, content)
+		return
+	}
+	fmt.Fprintf(w, `<progress value="%s" max="%s">%s/%s</progress>`,
+		template.HTMLEscapeString(formatScalar(v)), template.HTMLEscapeString(formatScalar(m)),
+		template.HTMLEscapeString(formatScalar(v)), template.HTMLEscapeString(formatScalar(m)))
+}
+
+// renderTable renders a table from an array of rows (each an array of cells), or from
+// {"head": [...], "rows": [[...]], "sortable": true, "types": ["text", "number", "date"]}.
+// Sortable tables get a sort button per header cell and a data-type hint per column
+// that sortTableScript uses to compare values. Other values render as a plain element.
+func renderTable(w io.Writer, content interface{}, flags map[string]interface{}) {
+	var head, rows, types []interface{}
+	sortable := false
+	switch v := content.(type) {
+	case []interface{}:
+		rows = v
+	case map[string]interface{}:
+		var ok bool
+		if rows, ok = v["rows"].([]interface{}); !ok {
+			renderMismatch(w, "table", `an array of rows or {"rows": [...]}`, content)
+			return
+		}
+		head, _ = v["head"].([]interface{})
+		types, _ = v["types"].([]interface{})
+		sortable, _ = v["sortable"].(bool)
+	default:
+		renderMismatch(w, "table", `an array of rows or {"rows": [...]}`, content)
+		return
+	}
+
+	columnType := func(i int) string {
+		if i < len(types) {
+			if t, ok := types[i].(string); ok && (t == "number" || t == "date") {
+				return t
+			}
+		}
+		return "text"
+	}
+
+	if sortable {
+		fmt.Fprint(w, `<table class="sortable-table">`)
+	} else {
+		fmt.Fprint(w, "<table>")
+	}
+	if len(head) > 0 {
+		fmt.Fprint(w, "<thead><tr>")
+		for i, cell := range head {
+			label := textHTML(formatScalar(cell), flags)
+			if sortable {
+				fmt.Fprintf(w, `<th data-type="%s" aria-sort="none"><button type="button" class="sort-button">%s</button></th>`, columnType(i), label)
+			} else {
+				fmt.Fprintf(w, "<th>%s</th>", label)
+			}
+		}
+		fmt.Fprint(w, "</tr></thead>")
+	}
+	fmt.Fprint(w, "<tbody>")
+	for _, row := range rows {
+		fmt.Fprint(w, "<tr>")
+		cells, ok := row.([]interface{})
+		if !ok {
+			cells = []interface{}{row}
+		}
+		for _, cell := range cells {
+			fmt.Fprintf(w, "<td>%s</td>", textHTML(formatScalar(cell), flags))
+		}
+		fmt.Fprint(w, "</tr>")
+	}
+	fmt.Fprint(w, "</tbody></table>")
+}
+
+// hasSortableTable reports whether any table on the page asks for client-side sorting
+func hasSortableTable(items []ContentItem) bool {
+	for _, item := range items {
+		for _, pair := range item.Content {
+			if table, ok := pair.Value.(map[string]interface{}); ok && pair.Key == "table" {
+				if sortable, _ := table["sortable"].(bool); sortable {
+					return true
 				}
 			}
+		}
+	}
+	return false
+}
+
+// renderCode renders a <pre><code> block. The value is the source (a string, or an array
+// of lines), or {"lang": "go", "src": ...} to add a language-go class that highlighting
+// libraries can target.
+func renderCode(w io.Writer, content interface{}) {
+	src := content
+	class := ""
+	if obj, ok := content.(map[string]interface{}); ok {
+		src = obj["src"]
+		if lang, ok := obj["lang"].(string); ok && lang != "" {
+			class = ` class="language-` + template.HTMLEscapeString(lang) + `"`
+		}
+	}
+
+	var text string
+	switch v := src.(type) {
+	case string:
+		text = v
+	case []interface{}:
+		lines := make([]string, len(v))
+		for i, line := range v {
+			lines[i] = formatScalar(line)
+		}
+		text = strings.Join(lines, "\n")
+	default:
+		text = formatScalar(v)
+	}
+
+	fmt.Fprintf(w, "<pre><code%s>%s</code></pre>", class, template.HTMLEscapeString(text))
+}
+
+func renderHTML(w http.ResponseWriter, items []ContentItem, flags map[string]interface{}, ctx renderContext) {
+	w.Header().Set("Content-Type", "text/html; charset="+pageCharset(flags))
+
+	// Under -csp or flags.csp, inline <style> and <script> blocks carry a per-response nonce
+	if wrapperTemplate == nil {
+		nonce := newNonce()
+		if policy := pagePolicy(flags, nonce); policy != "" {
+			ctx.Nonce = nonce
+			w.Header().Set("Content-Security-Policy", policy)
+		}
+	}
+
+	// renderPage fails under -strict before writing anything, so the 500 replaces the whole page
+	start := time.Now()
+	defer func() { metrics.observeRender(time.Since(start)) }()
+
+	// The header has to precede the body, so under -server-timing the page is buffered
+	if ctx.Timing != nil {
+		var buf bytes.Buffer
+		err := renderPage(&buf, items, flags, ctx)
+		ctx.Timing.since("render", "Render", start)
+		w.Header().Set("Server-Timing", ctx.Timing.header())
+		if err != nil {
+			http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(buf.Bytes())
+		return
+	}
+	if err := renderPage(w, items, flags, ctx); err != nil {
+		http.Error(w, "Error rendering page: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// renderPage writes the page for items to w, or only the items inside the -wrapper
+// template. Under -strict it returns the first template error without writing anything;
+// otherwise, without a layout template, the head is flushed before the items render.
+func renderPage(w io.Writer, items []ContentItem, flags map[string]interface{}, ctx renderContext) error {
+	templates := ctx.Templates
+
+	// With -wrapper the items are rendered into the wrapper template instead of a full page
+	if wrapperTemplate != nil {
+		var content bytes.Buffer
+		if err := renderItems(&content, items, flags, ctx); err != nil {
+			return err
+		}
+		var page bytes.Buffer
+		if err := wrapperTemplate.Execute(&page, fragmentData{Content: template.HTML(content.String()), Flags: flags}); err != nil {
+			if strictMode {
+				return fmt.Errorf("wrapper: %v", err)
+			}
+			fmt.Fprintf(&page, "<!-- Error rendering wrapper: %v -->", err)
+		}
+		_, err := page.WriteTo(w)
+		return err
+	}
+
+	// Under -strict the items are rendered before anything is written, so a failure can
+	// still send a 500. Otherwise they're rendered after the head has gone out.
+	var body *bytes.Buffer
+	if strictMode {
+		body = new(bytes.Buffer)
+		if err := renderItems(body, items, flags, ctx); err != nil {
+			return err
+		}
+	}
 
-			// If it's a non-standard tag without a template, skip rendering (already in JS)
-			if !standardTags[tag] {
+	nonceAttr := ""
+	if ctx.Nonce != "" {
+		nonceAttr = ` nonce="` + ctx.Nonce + `"`
+	}
+
+	// Document language from flags, falling back to English for missing or malformed tags
+	lang := "en"
+	if l, ok := flags["lang"].(string); ok && langPattern.MatchString(l) {
+		lang = l
+	}
+
+	// A layout template places the head's contents and the body's in its own shell, so
+	// they're built separately for it. The built-in shell is written as the page goes.
+	layout := layoutTemplate(templates)
+	out := bufio.NewWriter(w)
+	var headBuf, contentBuf bytes.Buffer
+	head, content := io.Writer(out), io.Writer(out)
+	if layout != nil {
+		head, content = &headBuf, &contentBuf
+	} else {
+		fmt.Fprint(out, pageStart(lang))
+	}
+	fmt.Fprintf(head, `    <meta charset="%s">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>%s</title>
+`, pageCharset(flags), template.HTMLEscapeString(pageTitle(items, flags)))
+
+	// Add the CSS libraries specified in flags, each resource once in first-seen order
+	emitted := make(map[string]bool)
+	for _, cssLib := range cssLibs(flags) {
+		for _, resource := range cssLibResources[cssLib] {
+			if emitted[resource] {
 				continue
 			}
+			emitted[resource] = true
+			if strings.HasSuffix(resource, ".css") {
+				fmt.Fprintf(head, "    <link rel=\"stylesheet\" href=\"%s\"%s>\n", resource, nonceAttr)
+			} else {
+				fmt.Fprintf(head, "    <script src=\"%s\"%s></script>\n", resource, nonceAttr)
+			}
+		}
+	}
 
-			switch tag {
-			case "img":
-				val := fmt.Sprintf("%v", content)
-				fmt.Fprintf(w, `<img src="%s" alt="Image">`, val)
-			case "ul":
-				// Handle list items
-				fmt.Fprint(w, "<ul>")
-				if list, ok := content.([]interface{}); ok {
-					for _, li := range list {
-						fmt.Fprintf(w, "<li>%v</li>", li)
-					}
-				} else {
-					// Fallback if it's not a list
-					fmt.Fprintf(w, "<li>%v</li>", content)
+	// Link the active design's stylesheet (older cached designs may not have one)
+	if ctx.DesignUUID != "" {
+		if _, err := os.Stat(filepath.Join(designCacheDir, ctx.DesignUUID, "style.css")); err == nil {
+			fmt.Fprintf(head, `    <link rel="stylesheet" href="/_designs/%s/style.css">
+`, ctx.DesignUUID)
+		}
+	}
+
+	// Built-in styles, unless the page opts out to leave the layout to its csslib
+	styles := ""
+	if noDefaultStyle, ok := flags["nodefaultstyle"].(bool); !ok || !noDefaultStyle {
+		maxWidth := "800px"
+		if width, ok := flags["maxwidth"].(string); ok {
+			if cssLengthPattern.MatchString(width) {
+				maxWidth = width
+			} else {
+				fmt.Println("Ignoring maxwidth that isn't a CSS length or none:", width)
+			}
+		}
+		styles += `        body { font-family: sans-serif; line-height: 1.6; padding: 20px; max-width: ` + maxWidth + `; margin: 0 auto; }
+        img { max-width: 100%; height: auto; }
+`
+	}
+
+	// Grid layout arranges the content items in columns instead of stacking them
+	gridLayout := false
+	if layout, ok := flags["layout"].(string); ok && strings.ToLower(layout) == "grid" {
+		gridLayout = true
+		columns := flagInt(flags, "columns", 3)
+		if columns < 1 || columns > 12 {
+			columns = 3
+		}
+		styles += fmt.Sprintf(`        .items-grid { display: grid; grid-template-columns: repeat(%d, minmax(0, 1fr)); gap: 20px; }
+        @media (max-width: 600px) { .items-grid { grid-template-columns: 1fr; } }
+`, columns)
+	}
+
+	// Reading progress bar, colored with the active design's accent when there is one
+	readingProgress, _ := flags["readingprogress"].(bool)
+	if readingProgress {
+		styles += `        .reading-progress { position: fixed; top: 0; left: 0; width: 100%; height: 4px; z-index: 1000; }
+        .reading-progress-bar { height: 100%; width: 0; background: var(--design-accent, #3498db); }
+`
+	}
+
+	// Copy-link buttons stay hidden until their item is hovered or focused
+	copyLinks, _ := flags["copylinks"].(bool)
+	if copyLinks {
+		styles += `        .item-anchored { position: relative; }
+        .item-anchor, .copy-link { opacity: 0; transition: opacity 0.2s; }
+        .item-anchored:hover .item-anchor, .item-anchored:hover .copy-link, .copy-link:focus { opacity: 1; }
+        .item-anchor { position: absolute; left: -1em; text-decoration: none; }
+        .copy-link { float: right; font-size: 0.8em; }
+`
+	}
+
+	// flags.autodark follows the OS theme, whether or not a design is active
+	if autoDark, _ := flags["autodark"].(bool); autoDark {
+		styles += `        :root { color-scheme: light dark; }
+        @media (prefers-color-scheme: dark) {
+            body { background: #121212; color: #e0e0e0; }
+            a { color: #8ab4f8; }
+        }
+`
+	}
+
+	// Page CSS from flags comes last so its rules win over the defaults
+	if css, ok := flags["css"].(string); ok && css != "" {
+		// Keep the CSS from closing the style element early
+		styles += "        " + strings.ReplaceAll(css, "</", `<\/`) + "\n"
+	}
+
+	if styles != "" {
+		fmt.Fprintf(head, "    <style%s>\n%s    </style>\n", nonceAttr, styles)
+	}
+
+	// First pass: collect non-standard tags
+	nonStandardData := make(map[string]interface{})
+	collectCustomContent(nonStandardData, items, flags, templates)
+
+	// Inject non-standard data as JavaScript variables, unless the page keeps it server-side.
+	// A streamed page declares customContent for its later items to add to.
+	noJSInject, _ := flags["nojsinject"].(bool)
+	if (len(nonStandardData) > 0 || ctx.More != nil) && !noJSInject {
+		fmt.Fprint(head, `<script`+nonceAttr+`>
+        // Non-standard tag content accessible to client
+        var customContent = {};
+`)
+		for tag, content := range nonStandardData {
+			jsonContent, _ := json.Marshal(content)
+			fmt.Fprintf(head, "        customContent['%s'] = %s;\n", tag, jsonContent)
+		}
+		fmt.Fprint(head, `    </script>
+`)
+	}
+
+	flush := func() error {
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}
+	if layout == nil {
+		fmt.Fprint(out, "</head><body>")
+		// Send the head now, so the browser can fetch stylesheets while the items render
+		if body == nil {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// flags.container replaces the wrapper's class, or drops it when false
+	container := ` class="container"`
+	switch c := flags["container"].(type) {
+	case bool:
+		if !c {
+			container = ""
+		}
+	case string:
+		container = classAttr(c)
+	}
+	fmt.Fprintf(content, "<div%s>", container)
+	if readingProgress {
+		fmt.Fprintf(content, `<div class="reading-progress" aria-hidden="true"><div class="reading-progress-bar" id="reading-progress-bar"></div></div>
+<script%s>%s</script>`, nonceAttr, readingProgressScript)
+	}
+	if search, ok := flags["search"].(bool); ok && search && searchIndex {
+		fmt.Fprintf(content, `<div class="site-search"><input type="search" id="site-search" placeholder="Search" aria-label="Search pages"><ul id="site-search-results"></ul></div>
+<script%s>%s</script>`, nonceAttr, searchScript)
+	}
+	if copyLinks {
+		fmt.Fprintf(content, "<script%s>%s</script>", nonceAttr, copyLinkScript)
+	}
+	if hasSortableTable(items) {
+		fmt.Fprintf(content, "<script%s>%s</script>", nonceAttr, sortTableScript)
+	}
+	if gridLayout {
+		fmt.Fprint(content, `<div class="items-grid">`)
+	}
+
+	// A streamed page's later items go out as they're read, each flushed before the next
+	// line is and preceded by a script adding its custom tags to customContent. Once the
+	// page is on its way, a line that fails to parse can only end it early.
+	streamedSortable := false
+	if more := ctx.More; more != nil && layout == nil {
+		ctx.More = func() (ContentItem, bool, error) {
+			if err := flush(); err != nil {
+				return ContentItem{}, false, err
+			}
+			item, ok, err := more()
+			if err != nil {
+				fmt.Println("Error streaming page:", err)
+				fmt.Fprintf(content, "<!-- Error reading the page: %v -->", err)
+				return ContentItem{}, false, nil
+			}
+			if !ok {
+				return item, false, nil
+			}
+			custom := make(map[string]interface{})
+			collectCustomContent(custom, []ContentItem{item}, flags, templates)
+			if len(custom) > 0 && !noJSInject {
+				fmt.Fprintf(content, "<script%s>", nonceAttr)
+				for tag, value := range custom {
+					jsonContent, _ := json.Marshal(value)
+					fmt.Fprintf(content, "customContent['%s'] = %s;", tag, jsonContent)
 				}
-				fmt.Fprint(w, "</ul>")
-			default:
-				val := fmt.Sprintf("%v", content)
-				fmt.Fprintf(w, `<%s>%s</%s>`, tag, val, tag)
+				fmt.Fprint(content, "</script>")
+			}
+			streamedSortable = streamedSortable || hasSortableTable([]ContentItem{item})
+			return item, true, nil
+		}
+	}
+
+	if body != nil {
+		body.WriteTo(content)
+	} else if err := renderItems(content, items, flags, ctx); err != nil {
+		return err
+	}
+	if streamedSortable && !hasSortableTable(items) {
+		fmt.Fprintf(content, "<script%s>%s</script>", nonceAttr, sortTableScript)
+	}
+
+	if gridLayout {
+		fmt.Fprint(content, "</div>")
+	}
+	fmt.Fprint(content, "</div>")
+	writeBodyScripts(content, flags, nonceAttr)
+
+	if layout == nil {
+		fmt.Fprint(out, `</body></html>`)
+		return out.Flush()
+	}
+
+	// components/layout.html, when a template layer has one, replaces the built-in shell
+	var page bytes.Buffer
+	data := layoutData{
+		Content: template.HTML(contentBuf.String()),
+		Head:    template.HTML(headBuf.String()),
+		Flags:   flags,
+		Lang:    lang,
+	}
+	err := layout.Execute(&page, data)
+	if err == nil {
+		_, err = page.WriteTo(w)
+		return err
+	}
+	if strictMode {
+		return fmt.Errorf("layout: %v", err)
+	}
+	fmt.Printf("Error rendering layout.html, using the built-in page shell: %v\n", err)
+	fmt.Fprint(out, pageStart(lang))
+	headBuf.WriteTo(out)
+	fmt.Fprint(out, "</head><body>")
+	contentBuf.WriteTo(out)
+	fmt.Fprint(out, `</body></html>`)
+	return out.Flush()
+}
+
+// collectCustomContent adds the values of the tags in items that have neither a template
+// nor built-in rendering to data, for the customContent script
+func collectCustomContent(data map[string]interface{}, items []ContentItem, flags map[string]interface{}, templates *template.Template) {
+	for _, item := range items {
+		for _, pair := range item.Content {
+			if !isStandardTag(pair.Key, flags) && !builtinTags[pair.Key] && tagTemplate(templates, pair.Key) == nil {
+				data[pair.Key] = pair.Value
 			}
 		}
+	}
+}
+
+// pageStart is the built-in page shell up to the head's contents
+func pageStart(lang string) string {
+	return `<!DOCTYPE html>
+<html lang="` + template.HTMLEscapeString(lang) + `">
+<head>
+`
+}
+
+// layoutData is passed to components/layout.html. Head holds the head's contents (meta
+// tags, title, stylesheets and scripts) and Content the body's, the rendered items in
+// their container.
+type layoutData struct {
+	Content template.HTML
+	Head    template.HTML
+	Flags   map[string]interface{}
+	Lang    string
+}
+
+// layoutTemplate returns the page's layout.html template, or nil to use the built-in shell
+func layoutTemplate(templates *template.Template) *template.Template {
+	if templates == nil {
+		return nil
+	}
+	return templates.Lookup("layout.html")
+}
 
-		// Close the div wrapper
-		fmt.Fprint(w, "</div>")
+// tagTemplate returns the template that renders tag, tag.html or a template defined
+// as tag, or nil. layout.html is the page shell, not a tag, so a "layout" key has none.
+func tagTemplate(templates *template.Template, tag string) *template.Template {
+	if templates == nil || tag == "layout" || tag == "layout.html" {
+		return nil
 	}
+	if tmpl := templates.Lookup(tag + ".html"); tmpl != nil {
+		return tmpl
+	}
+	return templates.Lookup(tag)
+}
 
-	fmt.Fprint(w, `</div></body></html>`)
+// writeBodyScripts writes flags.bodyscripts before </body>, e.g. analytics snippets.
+// Each entry is a script URL, relative or http(s), or {"inline": "..."} for inline code.
+func writeBodyScripts(w io.Writer, flags map[string]interface{}, nonceAttr string) {
+	scripts, _ := flags["bodyscripts"].([]interface{})
+	for _, script := range scripts {
+		switch v := script.(type) {
+		case string:
+			u, err := url.Parse(strings.TrimSpace(v))
+			if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+				fmt.Println("Ignoring body script with unsupported URL:", v)
+				continue
+			}
+			fmt.Fprintf(w, `<script src="%s"%s></script>`, template.HTMLEscapeString(u.String()), nonceAttr)
+		case map[string]interface{}:
+			code, ok := v["inline"].(string)
+			if !ok {
+				fmt.Println("Ignoring body script without inline code")
+				continue
+			}
+			// Keep the code from closing the script element early
+			fmt.Fprintf(w, "<script%s>%s</script>", nonceAttr, strings.ReplaceAll(code, "</", `<\/`))
+		}
+	}
 }
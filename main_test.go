@@ -0,0 +1,1232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSite writes files, by slash-separated path, into a temporary content directory
+// and points the server at it with every flag at its default. It returns the directory.
+func newTestSite(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		writeFile(t, filepath.Join(dir, filepath.FromSlash(name)), data)
+	}
+
+	contentDir = dir
+	designCacheDir = filepath.Join(t.TempDir(), "cached")
+	aiDesign.Store(false)
+	adminToken = ""
+	checkImages, checkRemoteImages = false, false
+	scalarTag = "p"
+	cspEnabled = false
+	watchFiles, cacheTemplates = false, false
+	assetMaxAge = time.Hour
+	wrapperTemplate = nil
+	includeFallback = "placeholder"
+	trailingSlash = ""
+	baseURL = ""
+	strictMode = false
+	searchIndex, contentIndex = false, false
+	allowFileParam, allowPreview, rawJSON = false, false, false
+	serverTimingEnabled, metricsEnabled = false, false
+	jsonComments = false
+	maxFileSize = 10 << 20
+	siteAuth = ""
+	siteFlags = nil
+	customRoutes = nil
+	return dir
+}
+
+// writeFile writes data to path, creating its directory
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve sends r through the server's routes and returns the recorded response
+func serve(r *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	buildMux().ServeHTTP(rec, r)
+	return rec
+}
+
+// checkContains reports each of want missing from got and each of notWant found in it
+func checkContains(t *testing.T, got string, want, notWant []string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(got, w) {
+			t.Errorf("missing %q in:\n%s", w, got)
+		}
+	}
+	for _, w := range notWant {
+		if strings.Contains(got, w) {
+			t.Errorf("unexpected %q in:\n%s", w, got)
+		}
+	}
+}
+
+func TestCheckImageReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		missing int
+	}{
+		{"existing local image", `{"a": {"img": "/assets/favicon.png"}}`, 0},
+		{"missing local image", `{"a": {"img": "/assets/missing.png"}}`, 1},
+		{"missing src in an img object", `{"a": {"img": {"src": "assets/missing.png?v=2", "alt": "x"}}}`, 1},
+		{"empty src", `{"a": {"img": ""}}`, 1},
+		{"remote images are only checked with -check-remote-images", `{"a": {"img": "https://example.com/x.png"}}`, 0},
+		{"data URI", `{"a": {"img": "data:image/png;base64,AAAA"}}`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": tt.content})
+			if got := checkImageReferences(); got != tt.missing {
+				t.Errorf("checkImageReferences() = %d, want %d", got, tt.missing)
+			}
+		})
+	}
+}
+
+func TestRenderAccordion(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "each section is a collapsible details element",
+			content: `[{"title": "Shipping?", "content": "Two days."}, {"title": "Returns?", "content": "30 days.", "open": true}]`,
+			want: []string{
+				`<div class="accordion">`,
+				`<details><summary>Shipping?</summary><div>Two days.</div></details>`,
+				`<details open><summary>Returns?</summary><div>30 days.</div></details>`,
+			},
+			notWant: []string{"name="},
+		},
+		{
+			name:    "single mode names the group",
+			content: `{"mode": "single", "sections": [{"title": "A", "content": "B"}]}`,
+			want:    []string{`<details name="faq"><summary>A</summary><div>B</div></details>`},
+		},
+		{
+			name:    "content is escaped",
+			content: `[{"title": "<b>T</b>", "content": "<script>x</script>"}]`,
+			want:    []string{"<summary>&lt;b&gt;T&lt;/b&gt;</summary><div>&lt;script&gt;x&lt;/script&gt;</div>"},
+			notWant: []string{"<script>"},
+		},
+		{
+			name:    "a string isn't a list of sections",
+			content: `"FAQ"`,
+			want:    []string{`<p class="type-mismatch">FAQ</p>`},
+			notWant: []string{"<details"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var content interface{}
+			if err := decodeJSON([]byte(tt.content), &content); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			renderAccordion(&out, "faq", content)
+			checkContains(t, out.String(), tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestScalarRoot(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		scalarTag string
+		want      string
+	}{
+		{"string", `"Hello, <world>"`, "p", "<div id='1'><p>Hello, &lt;world&gt;</p></div>"},
+		{"number", `42.5`, "p", "<div id='1'><p>42.5</p></div>"},
+		{"boolean", `true`, "p", "<div id='1'><p>true</p></div>"},
+		{"-scalar-tag", `"Hello"`, "h1", "<div id='1'><h1>Hello</h1></div>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": tt.content})
+			scalarTag = tt.scalarTag
+			rec := serve(httptest.NewRequest("GET", "/", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			checkContains(t, rec.Body.String(), []string{tt.want}, nil)
+		})
+	}
+}
+
+func TestRegisterRoute(t *testing.T) {
+	custom := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("custom"))
+	})
+	tests := []struct {
+		name    string
+		pattern string
+		target  string
+		want    string
+	}{
+		{"no custom route", "", "/", "<h1>Home</h1>"},
+		{"a new path", "/api/hook", "/api/hook", "custom"},
+		{"the new path leaves pages alone", "/api/hook", "/", "<h1>Home</h1>"},
+		{"the page handler's pattern", "/", "/", "custom"},
+		{"a built-in route", "/healthz", "/healthz", "custom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"a": {"h1": "Home"}}`})
+			if tt.pattern != "" {
+				RegisterRoute(tt.pattern, custom)
+			}
+			rec := serve(httptest.NewRequest("GET", tt.target, nil))
+			checkContains(t, rec.Body.String(), []string{tt.want}, nil)
+		})
+	}
+	customRoutes = nil
+}
+
+func TestStyleNonce(t *testing.T) {
+	stylePolicy := regexp.MustCompile(`style-src [^;]*'nonce-([^']+)'`)
+	tests := []struct {
+		name    string
+		csp     bool
+		flags   string
+		wantCSP bool
+	}{
+		{"-csp", true, `{}`, true},
+		{"flags.csp true", false, `{"csp": true}`, true},
+		{"flags.csp policy", false, `{"csp": "style-src 'nonce-{nonce}'"}`, true},
+		{"flags.csp false overrides -csp", true, `{"csp": false}`, false},
+		{"no policy", false, `{}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"flags": ` + tt.flags + `, "a": {"p": "x"}}`})
+			cspEnabled = tt.csp
+			rec := serve(httptest.NewRequest("GET", "/", nil))
+			policy := rec.Header().Get("Content-Security-Policy")
+			if !tt.wantCSP {
+				if policy != "" {
+					t.Errorf("unexpected policy %q", policy)
+				}
+				checkContains(t, rec.Body.String(), []string{"<style>"}, []string{"nonce="})
+				return
+			}
+			m := stylePolicy.FindStringSubmatch(policy)
+			if m == nil {
+				t.Fatalf("no style-src nonce in policy %q", policy)
+			}
+			checkContains(t, rec.Body.String(), []string{`<style nonce="` + m[1] + `">`}, nil)
+		})
+	}
+}
+
+func TestGridLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   string
+		want    []string
+		notWant []string
+	}{
+		{"columns from the flag", `{"layout": "grid", "columns": 4}`, []string{"repeat(4, minmax(0, 1fr))", `<div class="items-grid"><div id='a'>`}, nil},
+		{"three columns by default", `{"layout": "grid"}`, []string{"repeat(3, minmax(0, 1fr))", `<div class="items-grid">`}, nil},
+		{"out of range columns", `{"layout": "grid", "columns": 20}`, []string{"repeat(3, minmax(0, 1fr))"}, []string{"repeat(20"}},
+		{"stack", `{"layout": "stack", "columns": 4}`, nil, []string{"items-grid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"flags": ` + tt.flags + `, "a": {"p": "1"}, "b": {"p": "2"}}`})
+			rec := serve(httptest.NewRequest("GET", "/", nil))
+			checkContains(t, rec.Body.String(), tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestLargeNumbers(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"64-bit ID", `9007199254740993`, "<p>9007199254740993</p>"},
+		{"beyond 64 bits", `123456789012345678901234567890`, "<p>123456789012345678901234567890</p>"},
+		{"exponent", `1e21`, "<p>1000000000000000000000</p>"},
+		{"decimal", `0.1`, "<p>0.1</p>"},
+		{"small exponent", `1.5e-7`, "<p>0.00000015</p>"},
+		{"list item", `[9007199254740993]`, "<li>9007199254740993</li>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tag := "p"
+			if strings.HasPrefix(tt.value, "[") {
+				tag = "ul"
+			}
+			newTestSite(t, map[string]string{"index.json": `{"a": {"` + tag + `": ` + tt.value + `}}`})
+			rec := serve(httptest.NewRequest("GET", "/", nil))
+			checkContains(t, rec.Body.String(), []string{tt.want}, nil)
+		})
+	}
+}
+
+// renderTemplate executes the template name of the set layered from dirs with value
+func renderTemplate(t *testing.T, dirs []string, name string, value interface{}) string {
+	t.Helper()
+	tmpl := loadTemplates(dirs).Lookup(name)
+	if tmpl == nil {
+		t.Fatalf("no template %s in %q", name, dirs)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, value); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestDesignTemplateReload(t *testing.T) {
+	tests := []struct {
+		name  string
+		watch bool
+	}{
+		{"restat on each load", false},
+		{"-watch", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			watchFiles = tt.watch
+			uuid := generateUUID()
+			file := filepath.Join(designCacheDir, uuid, "h1.html")
+			writeFile(t, file, `<h1 class="old">{{.}}</h1>`)
+			dirs := templateDirs(uuid, "")
+			if got := renderTemplate(t, dirs, "h1.html", "T"); got != `<h1 class="old">T</h1>` {
+				t.Fatalf("first render = %q", got)
+			}
+
+			writeFile(t, file, `<h1 class="edited">{{.}}</h1>`)
+			if tt.watch {
+				// The watcher's tick, without waiting for it
+				dropChangedTemplates()
+			}
+			if got := renderTemplate(t, dirs, "h1.html", "T"); got != `<h1 class="edited">T</h1>` {
+				t.Errorf("render after the edit = %q", got)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	site := map[string]string{
+		"index.json":         `{"flags": {"search": true}, "a": {"h1": "Welcome", "p": "public text"}, "b": {"_when": "promo", "p": "hidden promo"}}`,
+		"index.private.json": `{"flags": {"auth": "u:p"}, "a": {"h1": "Private", "p": "secret text"}}`,
+	}
+	tests := []struct {
+		name       string
+		search     bool
+		wantStatus int
+		wantBox    bool
+	}{
+		{"enabled", true, http.StatusOK, true},
+		{"disabled by default", false, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, site)
+			searchIndex = tt.search
+
+			page := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			if got := strings.Contains(page, `id="site-search"`); got != tt.wantBox {
+				t.Errorf("search box shown = %v, want %v", got, tt.wantBox)
+			}
+			if got := strings.Contains(page, searchScript); got != tt.wantBox {
+				t.Errorf("search script shown = %v, want %v", got, tt.wantBox)
+			}
+
+			rec := serve(httptest.NewRequest("GET", "/_search", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("/_search status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var entries []searchEntry
+			if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+				t.Fatal(err)
+			}
+			want := []searchEntry{{URL: "/", Title: "Welcome", Text: "Welcome public text"}}
+			if !reflect.DeepEqual(entries, want) {
+				t.Errorf("/_search = %+v, want %+v", entries, want)
+			}
+		})
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		wantTotal int
+		wantUUIDs int
+	}{
+		{"defaults", "/_designs", 3, 3},
+		{"trailing slash", "/_designs/", 3, 3},
+		{"limit", "/_designs?limit=2", 3, 2},
+		{"limit and offset", "/_designs?limit=2&offset=2", 3, 1},
+		{"offset past the end", "/_designs?offset=10", 3, 0},
+		{"invalid values use the defaults", "/_designs?limit=x&offset=-1", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			for i := 0; i < 3; i++ {
+				writeFile(t, filepath.Join(designCacheDir, generateUUID(), "prompt.txt"), "dark")
+			}
+			adminToken = "secret"
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := serve(req)
+			var list struct {
+				Total   int
+				Designs []designEntry
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if list.Total != tt.wantTotal || len(list.Designs) != tt.wantUUIDs {
+				t.Errorf("total %d with %d designs, want %d with %d", list.Total, len(list.Designs), tt.wantTotal, tt.wantUUIDs)
+			}
+		})
+	}
+
+	indexTests := []struct {
+		name    string
+		target  string
+		want    []string
+		notWant []string
+	}{
+		{"all pages", "/_index", []string{"Pages 1-3 of 3", `href="/index.a"`, `href="/index.c"`}, []string{`rel="next"`, `rel="prev"`}},
+		{"first page", "/_index?limit=2", []string{"Pages 1-2 of 3", `href="/index.b"`, `href="/_index?limit=2&amp;offset=2" rel="next"`}, []string{`href="/index.c"`}},
+		{"last page", "/_index?limit=2&offset=2", []string{"Pages 3-3 of 3", `href="/index.c"`, `href="/_index?limit=2&amp;offset=0" rel="prev"`}, []string{`href="/index.a"`, `rel="next"`}},
+		{"past the end", "/_index?offset=5", []string{"No pages at offset 5 of 3"}, []string{"<li>"}},
+	}
+	for _, tt := range indexTests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{
+				"index.a.json": `{"a": {"h1": "A"}}`,
+				"index.b.json": `{"a": {"h1": "B"}}`,
+				"index.c.json": `{"a": {"h1": "C"}}`,
+			})
+			contentIndex = true
+			rec := serve(httptest.NewRequest("GET", tt.target, nil))
+			checkContains(t, rec.Body.String(), tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestDesignListAccess(t *testing.T) {
+	const uuid = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name       string
+		adminToken string
+		target     string
+		token      string
+		wantStatus int
+	}{
+		{"listing off without -admin-token", "", "/_designs", "", http.StatusNotFound},
+		{"listing needs the token", "secret", "/_designs", "", http.StatusUnauthorized},
+		{"listing with a wrong token", "secret", "/_designs/", "nope", http.StatusUnauthorized},
+		{"listing with the token", "secret", "/_designs", "secret", http.StatusOK},
+		{"stylesheet is public", "", "/_designs/" + uuid + "/style.css", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			adminToken = tt.adminToken
+			writeFile(t, filepath.Join(designCacheDir, uuid, "prompt.txt"), "private prompt")
+			writeFile(t, filepath.Join(designCacheDir, uuid, "style.css"), "h1 {}")
+
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := serve(r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := strings.Contains(rec.Body.String(), "private prompt"); got != (tt.wantStatus == http.StatusOK && tt.token != "") {
+				t.Errorf("prompt shown = %v in %s", got, rec.Body)
+			}
+		})
+	}
+}
+
+func TestReadingProgress(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags string
+		want  bool
+	}{
+		{"enabled", `{"readingprogress": true}`, true},
+		{"disabled", `{"readingprogress": false}`, false},
+		{"not set", `{}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"flags": ` + tt.flags + `, "a": {"p": "x"}}`})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			for _, part := range []string{`<div class="reading-progress-bar" id="reading-progress-bar">`, readingProgressScript, "var(--design-accent, #3498db)"} {
+				if got := strings.Contains(body, part); got != tt.want {
+					t.Errorf("%q shown = %v, want %v", part, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		wrapper string
+		want    string
+	}{
+		{"no wrapper", "", "<div class=\"container\"><div id='a'><p>x</p></div></div></body></html>"},
+		{"wrapper", `<section class="embed" data-title="{{.Flags.title}}">{{.Content}}</section>`, `<section class="embed" data-title="T"><div id='a'><p>x</p></div></section>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"flags": {"title": "T"}, "a": {"p": "x"}}`})
+			if tt.wrapper != "" {
+				wrapperTemplate = template.Must(template.New("wrapper.html").Parse(tt.wrapper))
+			}
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			if tt.wrapper == "" {
+				checkContains(t, body, []string{"<!DOCTYPE html>", tt.want}, nil)
+				return
+			}
+			if body != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageDefaults(t *testing.T) {
+	imgattrs := `{"loading": "lazy", "decoding": "async", "class": "img-fluid", "onerror": "alert(1)"}`
+	tests := []struct {
+		name     string
+		imgattrs string
+		img      string
+		want     string
+	}{
+		{"no defaults", "", `"/a.png"`, `<img src="/a.png" alt="Image">`},
+		{"defaults apply", imgattrs, `"/a.png"`, `<img src="/a.png" alt="Image" class="img-fluid" decoding="async" loading="lazy">`},
+		{"the img's own attributes win", imgattrs, `{"src": "/a.png", "alt": "A", "loading": "eager", "class": "hero"}`, `<img src="/a.png" alt="A" class="hero" decoding="async" loading="eager">`},
+		{"disallowed attributes are dropped", "", `{"src": "/a.png", "onload": "x()", "style": "x", "data-id": "7"}`, `<img src="/a.png" alt="Image" data-id="7">`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := `{}`
+			if tt.imgattrs != "" {
+				flags = `{"imgattrs": ` + tt.imgattrs + `}`
+			}
+			newTestSite(t, map[string]string{"index.json": `{"flags": ` + flags + `, "a": {"img": ` + tt.img + `}}`})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, []string{tt.want}, []string{"onerror", "onload"})
+		})
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	tests := []struct {
+		name       string
+		link       string
+		target     string
+		url        string
+		wantStatus int
+	}{
+		{"file inside -dir", "index.alias.json", "index.json", "/index.alias", http.StatusOK},
+		{"directory inside -dir", "docs", "real", "/docs/", http.StatusOK},
+		{"file escaping -dir", "index.leak.json", "../outside/index.json", "/index.leak", http.StatusNotFound},
+		{"directory escaping -dir", "leak", "../outside", "/leak/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := newTestSite(t, map[string]string{
+				"site/index.json":      `{"a": {"p": "public"}}`,
+				"site/real/index.json": `{"a": {"p": "public"}}`,
+				"outside/index.json":   `{"a": {"p": "secret"}}`,
+			})
+			contentDir = filepath.Join(dir, "site")
+			if err := os.Symlink(filepath.FromSlash(tt.target), filepath.Join(contentDir, tt.link)); err != nil {
+				t.Skip("symlinks aren't supported here:", err)
+			}
+			rec := serve(httptest.NewRequest("GET", tt.url, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if strings.Contains(rec.Body.String(), "secret") {
+				t.Errorf("served content from outside -dir: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestPageTitle(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"flags.title", `{"flags": {"title": "Explicit"}, "a": {"h1": "Heading"}}`, "<title>Explicit</title>"},
+		{"first heading", `{"a": {"p": "intro"}, "b": {"h2": "Second level", "h1": "Later"}}`, "<title>Second level</title>"},
+		{"blank flags.title falls back", `{"flags": {"title": " "}, "a": {"h1": "Heading"}}`, "<title>Heading</title>"},
+		{"default", `{"a": {"p": "no headings"}}`, "<title>JSON Server</title>"},
+		{"escaped", `{"flags": {"title": "<b>&</b>"}}`, "<title>&lt;b&gt;&amp;&lt;/b&gt;</title>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": tt.content})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, []string{tt.want}, nil)
+		})
+	}
+}
+
+func TestCacheTemplates(t *testing.T) {
+	tests := []struct {
+		name  string
+		cache bool
+		want  string
+	}{
+		{"restat by default", false, "<p class=\"edited\">x</p>"},
+		{"-cache-templates never restats", true, "<p class=\"old\">x</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			cacheTemplates = tt.cache
+			dir := t.TempDir()
+			file := filepath.Join(dir, "p.html")
+			writeFile(t, file, `<p class="old">{{.}}</p>`)
+			dirs := []string{"components", dir}
+			renderTemplate(t, dirs, "p.html", "x")
+
+			writeFile(t, file, `<p class="edited">{{.}}</p>`)
+			if got := renderTemplate(t, dirs, "p.html", "x"); got != tt.want {
+				t.Errorf("render after the edit = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "enabled",
+			flags: `{"copylinks": true}`,
+			want: []string{
+				`<div id="getting-started" class="item-anchored"><a class="item-anchor" href="#getting-started" aria-hidden="true">#</a><button type="button" class="copy-link" data-anchor="getting-started"`,
+				`<div id="getting-started-2" class="item-anchored"><a class="item-anchor" href="#getting-started-2"`,
+				`<div id="item" class="item-anchored">`,
+				copyLinkScript,
+			},
+		},
+		{
+			name:    "disabled",
+			flags:   `{}`,
+			want:    []string{"<div id='Getting Started'>"},
+			notWant: []string{"copy-link", "item-anchor"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"flags": ` + tt.flags + `, "Getting Started": {"p": "1"}, "getting-started": {"p": "2"}, "!!": {"p": "3"}}`})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestAIDesignToggle(t *testing.T) {
+	newTestSite(t, map[string]string{"index.json": `{"flags": {"designprompt": "dark toggle test"}, "a": {"h1": "x"}}`})
+	adminToken = "secret"
+	defer aiDesign.Store(false)
+
+	steps := []struct {
+		name       string
+		method     string
+		target     string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{"off at startup", "GET", "/", "", http.StatusOK, "<h1>x</h1>"},
+		{"toggling needs the token", "POST", "/_admin/ai-design?enabled=true", "wrong", http.StatusUnauthorized, "Unauthorized"},
+		{"still off", "GET", "/_admin/ai-design", "secret", http.StatusOK, `{"enabled":false}`},
+		{"enable", "POST", "/_admin/ai-design?enabled=true", "secret", http.StatusOK, `{"enabled":true}`},
+		{"pages use the design", "GET", "/", "", http.StatusOK, `<h1 class="design-h1">x</h1>`},
+		{"bad value", "POST", "/_admin/ai-design?enabled=maybe", "secret", http.StatusBadRequest, "enabled must be true or false"},
+		{"disable", "POST", "/_admin/ai-design?enabled=false", "secret", http.StatusOK, `{"enabled":false}`},
+		{"pages stop using the design", "GET", "/", "", http.StatusOK, "<h1>x</h1>"},
+	}
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, step.target, nil)
+		if step.token != "" {
+			r.Header.Set("Authorization", "Bearer "+step.token)
+		}
+		rec := serve(r)
+		if rec.Code != step.wantStatus {
+			t.Errorf("%s: status %d, want %d", step.name, rec.Code, step.wantStatus)
+		}
+		if !strings.Contains(rec.Body.String(), step.wantBody) {
+			t.Errorf("%s: missing %q in:\n%s", step.name, step.wantBody, rec.Body)
+		}
+	}
+
+	adminToken = ""
+	if rec := serve(httptest.NewRequest("POST", "/_admin/ai-design?enabled=true", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("without -admin-token: status %d, want 404", rec.Code)
+	}
+}
+
+func TestSortableTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		table   string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "sortable",
+			table: `{"sortable": true, "head": ["Name", "Size", "Date", "Note"], "types": ["text", "number", "date", "bogus"], "rows": [["a", 2, "2024-01-02", "x"]]}`,
+			want: []string{
+				`<table class="sortable-table">`,
+				`<th data-type="text" aria-sort="none"><button type="button" class="sort-button">Name</button></th>`,
+				`<th data-type="number" aria-sort="none">`,
+				`<th data-type="date" aria-sort="none">`,
+				`<th data-type="text" aria-sort="none"><button type="button" class="sort-button">Note</button></th>`,
+				sortTableScript,
+			},
+		},
+		{
+			name:    "static",
+			table:   `{"head": ["Name"], "rows": [["a"]]}`,
+			want:    []string{"<table><thead><tr><th>Name</th></tr></thead><tbody><tr><td>a</td></tr></tbody></table>"},
+			notWant: []string{"data-type", "sort-button", sortTableScript},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"a": {"table": ` + tt.table + `}}`})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestIncludeFallback(t *testing.T) {
+	tests := []struct {
+		name       string
+		include    string
+		fallback   string
+		strict     bool
+		wantStatus int
+		want       []string
+		notWant    []string
+	}{
+		{"include found", `{"$include": "part.json"}`, "placeholder", false, http.StatusOK, []string{"<h1>Top</h1>", "<p>included</p>"}, []string{"include-fallback"}},
+		{"placeholder by default", `{"$include": "missing.json"}`, "placeholder", false, http.StatusOK, []string{"<h1>Top</h1>", `<p class="include-fallback">` + defaultIncludePlaceholder + "</p>"}, nil},
+		{"skip", `{"$include": "missing.json", "$fallback": "skip"}`, "placeholder", false, http.StatusOK, []string{"<h1>Top</h1>"}, []string{"include-fallback"}},
+		{"custom text", `{"$include": "missing.json", "$fallback": "Back <soon>"}`, "placeholder", false, http.StatusOK, []string{`<p class="include-fallback">Back &lt;soon&gt;</p>`}, nil},
+		{"-include-fallback error", `{"$include": "missing.json"}`, "error", false, http.StatusInternalServerError, nil, []string{"<h1>Top</h1>"}},
+		{"-strict fails the request", `{"$include": "missing.json", "$fallback": "skip"}`, "placeholder", true, http.StatusInternalServerError, nil, []string{"<h1>Top</h1>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{
+				"index.json": `{"a": {"h1": "Top"}, "inc": ` + tt.include + `}`,
+				"part.json":  `{"b": {"p": "included"}}`,
+			})
+			includeFallback = tt.fallback
+			strictMode = tt.strict
+			rec := serve(httptest.NewRequest("GET", "/", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			checkContains(t, rec.Body.String(), tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestDesignRegenerate(t *testing.T) {
+	newTestSite(t, nil)
+	adminToken = "secret"
+	watchFiles = true
+	uuid := generateUUID()
+	dir := filepath.Join(designCacheDir, uuid)
+	writeFile(t, filepath.Join(dir, "prompt.txt"), "dark regenerate test")
+	writeFile(t, filepath.Join(dir, "h1.html"), `<h1 class="stale">{{.}}</h1>`)
+	dirs := templateDirs(uuid, "")
+	renderTemplate(t, dirs, "h1.html", "x")
+
+	steps := []struct {
+		name       string
+		method     string
+		target     string
+		token      string
+		wantStatus int
+	}{
+		{"POST only", "GET", "/_designs/" + uuid + "/regenerate", "secret", http.StatusMethodNotAllowed},
+		{"needs the token", "POST", "/_designs/" + uuid + "/regenerate", "", http.StatusUnauthorized},
+		{"unknown design", "POST", "/_designs/" + generateUUID() + "/regenerate", "secret", http.StatusNotFound},
+		{"regenerate", "POST", "/_designs/" + uuid + "/regenerate", "secret", http.StatusOK},
+	}
+	var rec *httptest.ResponseRecorder
+	for _, step := range steps {
+		r := httptest.NewRequest(step.method, step.target, nil)
+		if step.token != "" {
+			r.Header.Set("Authorization", "Bearer "+step.token)
+		}
+		if rec = serve(r); rec.Code != step.wantStatus {
+			t.Errorf("%s: status %d, want %d", step.name, rec.Code, step.wantStatus)
+		}
+	}
+
+	var entry designEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entry); err != nil || entry != (designEntry{UUID: uuid, Prompt: "dark regenerate test"}) {
+		t.Errorf("response %s (%v)", rec.Body, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "style.css")); err != nil {
+		t.Error("style.css wasn't regenerated:", err)
+	}
+	// -watch keeps the stale set until invalidated, so this shows the cache entry was dropped
+	if got := renderTemplate(t, dirs, "h1.html", "x"); got != `<h1 class="design-h1">x</h1>` {
+		t.Errorf("h1 after regenerating = %q", got)
+	}
+}
+
+func TestCitations(t *testing.T) {
+	bibliography := `{"knuth": {"author": "Knuth", "year": 1968, "title": "The Art of Computer Programming", "publisher": "Addison-Wesley"}, "dijkstra": {"author": "Dijkstra", "year": 1968, "title": "Go To Statement Considered Harmful"}}`
+	tests := []struct {
+		name    string
+		flags   string
+		cite    string
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "numeric",
+			flags: `{"bibliography": "refs.json"}`,
+			cite:  `["dijkstra", "knuth"]`,
+			want: []string{
+				`<span class="cite">[<a href="#ref-dijkstra">1</a>, <a href="#ref-knuth">2</a>]</span>`,
+				`<section class="bibliography"><h2>References</h2><ol><li id="ref-dijkstra">Dijkstra (1968). <cite>Go To Statement Considered Harmful</cite></li>`,
+				`<li id="ref-knuth">Knuth (1968). <cite>The Art of Computer Programming</cite>. Addison-Wesley</li>`,
+			},
+		},
+		{
+			name:  "author-year",
+			flags: `{"bibliography": "refs.json", "citationstyle": "author-year"}`,
+			cite:  `"knuth"`,
+			want:  []string{`<span class="cite">(<a href="#ref-knuth">Knuth, 1968</a>)</span>`},
+		},
+		{
+			name:  "missing key",
+			flags: `{"bibliography": "refs.json"}`,
+			cite:  `["knuth", "nobody"]`,
+			want: []string{
+				`<span class="cite-missing" title="Missing from bibliography">?nobody</span>`,
+				`<li id="ref-nobody" class="cite-missing">Missing reference: nobody</li>`,
+			},
+		},
+		{
+			name:    "missing bibliography",
+			flags:   `{"bibliography": "nope.json"}`,
+			cite:    `"knuth"`,
+			want:    []string{`?knuth`, "Missing reference: knuth"},
+			notWant: []string{`href="#ref-knuth"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{
+				"index.json": `{"flags": ` + tt.flags + `, "a": {"p": "As shown", "cite": ` + tt.cite + `}, "refs": {"bibliography": true}}`,
+				"refs.json":  bibliography,
+			})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestListClasses(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags string
+		want  []string
+	}{
+		{"no library", `{}`, []string{"<ul><li>a</li></ul>", "<ol><li>b</li></ol>"}},
+		{"bootstrap", `{"csslib": "bootstrap"}`, []string{`<ul class="list-group"><li class="list-group-item">a</li></ul>`, `<ol class="list-group list-group-numbered"><li class="list-group-item">b</li></ol>`}},
+		{"tailwind leaves li alone", `{"csslib": "tailwind"}`, []string{`<ul class="list-disc pl-5"><li>a</li></ul>`}},
+		{"flags.listclasses overrides the library", `{"csslib": "bootstrap", "listclasses": {"ul": "mine", "li": ""}}`, []string{`<ul class="mine"><li>a</li></ul>`, `<ol class="list-group list-group-numbered"><li>b</li></ol>`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"flags": ` + tt.flags + `, "a": {"ul": ["a"], "ol": ["b"]}}`})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, tt.want, nil)
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		strict  bool
+		wantErr bool
+		want    []string
+	}{
+		{"page", `{"flags": {"title": "T"}, "a": {"h1": "Hi"}}`, false, false, []string{"<!DOCTYPE html>", "<title>T</title>", "<div id='a'><h1>Hi</h1></div>"}},
+		{"template error is commented", `{"flags": {"designprompt": "DESIGN"}, "a": {"h1": "Hi"}}`, false, false, []string{"<!-- Error rendering template h1"}},
+		{"template error under -strict", `{"flags": {"designprompt": "DESIGN"}, "a": {"h1": "Hi"}}`, true, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			uuid := generateUUID()
+			writeFile(t, filepath.Join(designCacheDir, uuid, "h1.html"), `<h1>{{index .Value 10}}</h1>`)
+			aiDesign.Store(true)
+			defer aiDesign.Store(false)
+			strictMode = tt.strict
+
+			content := strings.Replace(tt.content, "DESIGN", uuid, 1)
+			items, flags, err := loadPage("index.json", []byte(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			err = Render(items, flags, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Render error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && out.Len() > 0 {
+				t.Errorf("Render wrote %q before failing", out.String())
+			}
+			checkContains(t, out.String(), tt.want, nil)
+		})
+	}
+}
+
+func TestTypeMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		tag   string
+		value string
+		want  string
+	}{
+		{"ul with a string", "ul", `"not a list"`, `<ul><li>not a list</li></ul>`},
+		{"ol with an object", "ol", `{"a": "<b>"}`, `<ol><li>{&#34;a&#34;:&#34;&lt;b&gt;&#34;}</li></ol>`},
+		{"table with a number", "table", `42`, `<p class="type-mismatch">42</p>`},
+		{"table with rows that aren't an array", "table", `{"rows": "x"}`, `<p class="type-mismatch">{&#34;rows&#34;:&#34;x&#34;}</p>`},
+		{"img with a number", "img", `7`, `<p class="type-mismatch">7</p>`},
+		{"img with an array", "img", `["a.png"]`, `<p class="type-mismatch">[&#34;a.png&#34;]</p>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.json": `{"a": {"` + tt.tag + `": ` + tt.value + `}}`})
+			body := serve(httptest.NewRequest("GET", "/", nil)).Body.String()
+			checkContains(t, body, []string{tt.want}, []string{"map[", "[]interface", "<img", "<table"})
+		})
+	}
+}
+
+func TestExportSite(t *testing.T) {
+	newTestSite(t, map[string]string{
+		"index.json":            `{"a": {"h1": "Home"}, "b": {"_when": "promo", "p": "promo only"}}`,
+		"blog/index.about.json": `{"a": {"h1": "About"}}`,
+		"index.broken.json":     `{"a": `,
+	})
+	outDir := t.TempDir()
+	pages, failed := exportSite(outDir)
+	if failed != 1 {
+		t.Errorf("%d failed, want 1 for index.broken.json", failed)
+	}
+	if len(pages) != 3 {
+		t.Errorf("%d pages, want 3", len(pages))
+	}
+
+	tests := []struct {
+		file    string
+		want    []string
+		notWant []string
+	}{
+		{"index.html", []string{"<!DOCTYPE html>", "<h1>Home</h1>"}, []string{"promo only"}},
+		{"blog/index.about.html", []string{"<title>About</title>", "<h1>About</h1>"}, nil},
+		{"assets/favicon.png", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join(outDir, filepath.FromSlash(tt.file)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkContains(t, string(data), tt.want, tt.notWant)
+		})
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "index.broken.html")); !os.IsNotExist(err) {
+		t.Errorf("index.broken.html was written (%v)", err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		file       string
+		patch      string
+		auth       bool
+		wantStatus int
+		want       []string
+		notWant    []string
+	}{
+		{"patch", "POST", "index.json", `{"hero": {"h1": "New title"}, "promo": null, "extra": {"p": "added"}}`, false, http.StatusOK, []string{"<h1>New title</h1>", "<p>added</p>"}, []string{"Old title", "sale"}},
+		{"POST only", "GET", "index.json", "", false, http.StatusMethodNotAllowed, nil, nil},
+		{"invalid patch", "POST", "index.json", `{`, false, http.StatusBadRequest, []string{"not valid JSON"}, nil},
+		{"missing file", "POST", "nope.json", `{}`, false, http.StatusNotFound, nil, nil},
+		{"outside the content directory", "POST", "../index.json", `{}`, false, http.StatusBadRequest, nil, nil},
+		{"jsonl", "POST", "index.feed.jsonl", `{}`, false, http.StatusBadRequest, []string{"doesn't apply to .jsonl"}, nil},
+		{"a patch can't drop auth", "POST", "index.private.json", `{"flags": null}`, false, http.StatusUnauthorized, nil, []string{"secret"}},
+		{"protected page with credentials", "POST", "index.private.json", `{"flags": null}`, true, http.StatusOK, []string{"secret"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{
+				"index.json":         `{"hero": {"h1": "Old title"}, "promo": {"p": "sale"}}`,
+				"index.feed.jsonl":   `{"p": "line"}`,
+				"index.private.json": `{"flags": {"auth": "u:p"}, "a": {"p": "secret"}}`,
+			})
+			allowPreview = true
+			r := httptest.NewRequest(tt.method, "/_preview?file="+tt.file, strings.NewReader(tt.patch))
+			if tt.auth {
+				r.SetBasicAuth("u", "p")
+			}
+			rec := serve(r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			checkContains(t, rec.Body.String(), tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestSitemap(t *testing.T) {
+	site := map[string]string{
+		"index.json":         `{"a": {"h1": "Home"}}`,
+		"blog/index.json":    `{"a": {"h1": "Blog"}}`,
+		"index.private.json": `{"flags": {"auth": "u:p"}, "a": {"h1": "Private"}}`,
+	}
+	tests := []struct {
+		name       string
+		baseURL    string
+		wantStatus int
+		want       []string
+		notWant    []string
+	}{
+		{"base url", "https://example.com/", http.StatusOK,
+			[]string{"<loc>https://example.com/</loc>", "<loc>https://example.com/blog/</loc>"},
+			[]string{"private", "evil.test"}},
+		{"no base url", "", http.StatusNotFound, nil, []string{"<loc>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, site)
+			baseURL = tt.baseURL
+
+			req := httptest.NewRequest("GET", "/sitemap.xml", nil)
+			req.Host = "evil.test"
+			rec := serve(req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			checkContains(t, rec.Body.String(), tt.want, tt.notWant)
+		})
+	}
+}
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		notWant []string
+	}{
+		{"page in the layout", `{"flags": {"designprompt": "DESIGN"}, "a": {"h1": "Hi"}}`,
+			[]string{`<main class="shell">`, "<h1>Hi</h1>", "<title>Hi</title>"},
+			[]string{"<!DOCTYPE html>"}},
+		{"a layout key isn't a tag", `{"flags": {"designprompt": "DESIGN"}, "a": {"layout": "x", "p": "y"}}`,
+			[]string{"<p>y</p>", `customContent['layout'] = "x"`},
+			[]string{"<!-- Error rendering template layout"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			uuid := generateUUID()
+			writeFile(t, filepath.Join(designCacheDir, uuid, "layout.html"), `<html><head>{{.Head}}</head><main class="shell">{{.Content}}</main></html>`)
+			aiDesign.Store(true)
+			defer aiDesign.Store(false)
+
+			content := strings.Replace(tt.content, "DESIGN", uuid, 1)
+			items, flags, err := loadPage("index.json", []byte(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := Render(items, flags, &out); err != nil {
+				t.Fatal(err)
+			}
+			checkContains(t, out.String(), tt.want, tt.notWant)
+			if n := strings.Count(out.String(), `class="shell"`); n != 1 {
+				t.Errorf("layout rendered %d times in:\n%s", n, out.String())
+			}
+		})
+	}
+}
+
+// flushRecorder is a ResponseRecorder that keeps what had been written at each Flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushes = append(r.flushes, r.Body.String())
+	r.ResponseRecorder.Flush()
+}
+
+func TestHeadFlushedFirst(t *testing.T) {
+	tests := []struct {
+		name      string
+		strict    bool
+		layout    bool
+		metrics   bool
+		wantFlush bool
+	}{
+		{"head before the items", false, false, false, true},
+		{"head before the items under -metrics", false, false, true, true},
+		{"-strict renders everything first", true, false, false, false},
+		{"layout renders everything first", false, true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, nil)
+			uuid := generateUUID()
+			writeFile(t, filepath.Join(designCacheDir, uuid, "h2.html"), `<h2>{{.Value}}</h2>`)
+			if tt.layout {
+				writeFile(t, filepath.Join(designCacheDir, uuid, "layout.html"), `<html><head>{{.Head}}</head><body>{{.Content}}</body></html>`)
+			}
+			writeFile(t, filepath.Join(contentDir, "index.json"), `{"flags": {"designprompt": "`+uuid+`"}, "a": {"h2": "Item"}}`)
+			aiDesign.Store(true)
+			defer aiDesign.Store(false)
+			strictMode = tt.strict
+			metricsEnabled = tt.metrics
+
+			rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			buildMux().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if flushed := len(rec.flushes) > 0; flushed != tt.wantFlush {
+				t.Fatalf("flushed = %v, want %v", flushed, tt.wantFlush)
+			}
+			checkContains(t, rec.Body.String(), []string{"<h2>Item</h2>"}, nil)
+			if tt.wantFlush {
+				checkContains(t, rec.flushes[0], []string{"<title>Item</title>", "</head><body>"}, []string{"<h2>Item</h2>"})
+			}
+		})
+	}
+}
+
+func TestJSONLinesStreaming(t *testing.T) {
+	feed := `{"flags": {"title": "Feed"}}
+{"h2": "one", "widget": 1}
+{"_when": "promo", "p": "hidden"}
+{"p": "two", "gadget": 2}
+{"table": {"sortable": true, "rows": [["a"]]}}
+`
+	tests := []struct {
+		name       string
+		content    string
+		strict     bool
+		sort       bool
+		wantStatus int
+		wantStream bool
+		want       []string
+		notWant    []string
+	}{
+		{"streamed", feed, false, false, http.StatusOK, true,
+			[]string{"<title>Feed</title>", "customContent['widget'] = 1;", "<script>customContent['gadget'] = 2;</script><div id='3'><p>two</p>", sortTableScript},
+			[]string{"hidden"}},
+		{"flags.sort needs every item", strings.Replace(feed, `"title": "Feed"`, `"title": "Feed", "sort": "alpha"`, 1), false, true, http.StatusOK, false,
+			[]string{"<div id='3'><p>two</p></div>", "customContent['gadget'] = 2;"}, nil},
+		{"-strict needs every item", feed, true, false, http.StatusOK, false,
+			[]string{"<div id='3'><p>two</p></div>"}, nil},
+		{"bad line ends a streamed page", feed + "{\"p\": x}\n{\"p\": \"after\"}\n", false, false, http.StatusOK, true,
+			[]string{"<div id='3'><p>two</p></div>", "<!-- Error reading the page: line 6, column", "</body></html>"},
+			[]string{"after"}},
+		{"bad line under -strict", feed + "{\"p\": x}\n", true, false, http.StatusBadRequest, false,
+			[]string{"line 6, column"}, nil},
+		{"late flags are ignored", feed + `{"flags": {"title": "Late"}}` + "\n", false, false, http.StatusOK, true,
+			[]string{"<title>Feed</title>"}, []string{"Late"}},
+		{"late flags under -strict", feed + `{"flags": {"title": "Late"}}` + "\n", true, false, http.StatusUnprocessableEntity, false,
+			[]string{"flags must come before the first item"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestSite(t, map[string]string{"index.feed.jsonl": tt.content})
+			strictMode = tt.strict
+
+			rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			buildMux().ServeHTTP(rec, httptest.NewRequest("GET", "/index.feed", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			checkContains(t, rec.Body.String(), tt.want, tt.notWant)
+
+			// Streamed, each item is flushed before the next line is read
+			streamed := len(rec.flushes) > 1
+			if streamed != tt.wantStream {
+				t.Fatalf("streamed = %v (%d flushes), want %v", streamed, len(rec.flushes), tt.wantStream)
+			}
+			if streamed {
+				checkContains(t, rec.flushes[0], []string{"</head><body>"}, []string{"<h2>one</h2>"})
+				last := rec.flushes[len(rec.flushes)-1]
+				checkContains(t, last, []string{"<h2>one</h2>", "<p>two</p>"}, []string{"</body></html>"})
+			}
+		})
+	}
+}